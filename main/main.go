@@ -8,7 +8,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Error! Must indicate the option: $go run main/main.go [prune/query]")
+		fmt.Println("Error! Must indicate the option: $go run main/main.go [prune/query/inspect/history/verify-proof/rehydrate/witness/sweep]")
 		return
 	}
 
@@ -17,7 +17,19 @@ func main() {
 		utils.DoPrune(os.Args[2:])
 	case "query":
 		utils.DoQuery(os.Args[2:])
+	case "inspect":
+		utils.DoInspect(os.Args[2:])
+	case "history":
+		utils.DoHistory(os.Args[2:])
+	case "verify-proof":
+		utils.DoVerifyProof(os.Args[2:])
+	case "rehydrate":
+		utils.DoRehydrate(os.Args[2:])
+	case "witness":
+		utils.DoWitness(os.Args[2:])
+	case "sweep":
+		utils.DoSweep(os.Args[2:])
 	default:
-		fmt.Println("Error! Must indicate the option: $go run main/main.go [prune/query]")
+		fmt.Println("Error! Must indicate the option: $go run main/main.go [prune/query/inspect/history/verify-proof/rehydrate/witness/sweep]")
 	}
 }
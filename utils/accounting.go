@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// spaceReport receives one row per pruned block, window and run when prune is
+// asked to measure the space its deletions free. Nil disables the measurement.
+var spaceReport *csv.Writer
+
+// measureSpace makes prune measure its deletions into the manifest without a
+// report, for sweep to read back.
+var measureSpace = false
+
+// measuringSpace reports whether prune measures the space of its deletions.
+func measuringSpace() bool {
+	return measureSpace || spaceReport != nil || impactReport != nil
+}
+
+// spaceStats counts trie nodes and their encoded bytes by kind. Extension
+// nodes are counted with the branches they lead to.
+type spaceStats struct {
+	LeafNodes    int `json:"leafNodes"`
+	LeafBytes    int `json:"leafBytes"`
+	BranchNodes  int `json:"branchNodes"`
+	BranchBytes  int `json:"branchBytes"`
+	StorageNodes int `json:"storageNodes"`
+	StorageBytes int `json:"storageBytes"`
+}
+
+func (s *spaceStats) add(o spaceStats) {
+	s.LeafNodes += o.LeafNodes
+	s.LeafBytes += o.LeafBytes
+	s.BranchNodes += o.BranchNodes
+	s.BranchBytes += o.BranchBytes
+	s.StorageNodes += o.StorageNodes
+	s.StorageBytes += o.StorageBytes
+}
+
+func (s spaceStats) nodes() int { return s.LeafNodes + s.BranchNodes + s.StorageNodes }
+func (s spaceStats) bytes() int { return s.LeafBytes + s.BranchBytes + s.StorageBytes }
+
+// countNode classifies an account trie node by its RLP encoding.
+func (s *spaceStats) countNode(blob []byte) {
+	if isLeafNode(blob) {
+		s.LeafNodes++
+		s.LeafBytes += len(blob)
+	} else {
+		s.BranchNodes++
+		s.BranchBytes += len(blob)
+	}
+}
+
+// isLeafNode reports whether blob encodes a short node whose compact key
+// carries the terminator flag.
+func isLeafNode(blob []byte) bool {
+	content, _, err := rlp.SplitList(blob)
+	if err != nil {
+		return false
+	}
+	if n, err := rlp.CountValues(content); err != nil || n != 2 {
+		return false
+	}
+	key, _, err := rlp.SplitString(content)
+	return err == nil && len(key) > 0 && key[0]&0x20 != 0
+}
+
+// proofSet collects trie nodes by hash, it satisfies ethdb.KeyValueWriter so
+// that Prove can write into it.
+type proofSet map[common.Hash][]byte
+
+func (p proofSet) Put(key []byte, value []byte) error {
+	p[common.BytesToHash(key)] = common.CopyBytes(value)
+	return nil
+}
+
+func (p proofSet) Delete(key []byte) error {
+	delete(p, common.BytesToHash(key))
+	return nil
+}
+
+// spaceUsage is the measurement of the deletions of one block. Removed holds
+// the nodes of the original trie that the pruned trie no longer references,
+// Added the nodes the pruned trie needs instead.
+type spaceUsage struct {
+	Removed spaceStats `json:"removed"`
+	Added   spaceStats `json:"added"`
+}
+
+func (u *spaceUsage) add(o spaceUsage) {
+	u.Removed.add(o.Removed)
+	u.Added.add(o.Added)
+}
+
+// freedBytes returns the net number of bytes the deletions free.
+func (u spaceUsage) freedBytes() int { return u.Removed.bytes() - u.Added.bytes() }
+
+// measurePruning compares the paths of the deleted accounts in the original
+// trie of root with the same paths in the pruned trie. Nodes present in only
+// one of them are what the deletions remove or add. The storage tries of the
+// deleted accounts are removed entirely.
+func measurePruning(triedb *trie.Database, root common.Hash, pruned *trie.StateTrie, deleted []common.Address, number uint64) (spaceUsage, error) {
+	var usage spaceUsage
+	origin, err := trie.NewStateTrie(common.Hash{}, root, triedb)
+	if err != nil {
+		return usage, wrapTrieErr(err, number, root)
+	}
+	originNodes, prunedNodes := proofSet{}, proofSet{}
+	for _, addr := range deleted {
+		key := crypto.Keccak256(addr.Bytes())
+		if err := origin.Prove(key, 0, originNodes); err != nil {
+			return usage, wrapTrieErr(err, number, root)
+		}
+		if err := pruned.Prove(key, 0, prunedNodes); err != nil {
+			return usage, wrapTrieErr(err, number, root)
+		}
+		acc, err := origin.TryGetAccount(addr.Bytes())
+		if err != nil {
+			return usage, wrapTrieErr(err, number, root)
+		}
+		if acc == nil || acc.Root == types.EmptyRootHash {
+			continue
+		}
+		storage, err := trie.NewStateTrie(crypto.Keccak256Hash(addr.Bytes()), acc.Root, triedb)
+		if err != nil {
+			return usage, wrapTrieErr(err, number, acc.Root)
+		}
+		it := storage.NodeIterator(nil)
+		for it.Next(true) {
+			if blob := it.NodeBlob(); blob != nil {
+				usage.Removed.StorageNodes++
+				usage.Removed.StorageBytes += len(blob)
+			}
+		}
+		if err := it.Error(); err != nil {
+			return usage, wrapTrieErr(err, number, acc.Root)
+		}
+	}
+	for hash, blob := range originNodes {
+		if _, ok := prunedNodes[hash]; !ok {
+			usage.Removed.countNode(blob)
+		}
+	}
+	for hash, blob := range prunedNodes {
+		if _, ok := originNodes[hash]; !ok {
+			usage.Added.countNode(blob)
+		}
+	}
+	return usage, nil
+}
+
+// openSpaceReport creates the CSV report and writes its header.
+func openSpaceReport(path string) (*os.File, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	spaceReport = csv.NewWriter(file)
+	spaceReport.Write([]string{"scope", "block", "deleted",
+		"removed_leaf_nodes", "removed_leaf_bytes", "removed_branch_nodes", "removed_branch_bytes",
+		"removed_storage_nodes", "removed_storage_bytes",
+		"added_leaf_nodes", "added_leaf_bytes", "added_branch_nodes", "added_branch_bytes",
+		"freed_nodes", "freed_bytes"})
+	return file, nil
+}
+
+// reportSpace writes one row of the report. Scope is block, window or total.
+func reportSpace(scope string, number uint64, deleted int, u spaceUsage) {
+	if spaceReport == nil {
+		return
+	}
+	itoa := strconv.Itoa
+	spaceReport.Write([]string{scope, fmt.Sprint(number), itoa(deleted),
+		itoa(u.Removed.LeafNodes), itoa(u.Removed.LeafBytes), itoa(u.Removed.BranchNodes), itoa(u.Removed.BranchBytes),
+		itoa(u.Removed.StorageNodes), itoa(u.Removed.StorageBytes),
+		itoa(u.Added.LeafNodes), itoa(u.Added.LeafBytes), itoa(u.Added.BranchNodes), itoa(u.Added.BranchBytes),
+		itoa(u.Removed.nodes() - u.Added.nodes()), itoa(u.freedBytes())})
+	spaceReport.Flush()
+}
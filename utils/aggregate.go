@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Aggregate summarises an account over a block range. Balances are taken at
+// the end of every block, values are in wei.
+type Aggregate struct {
+	From, To   uint64
+	Blocks     int
+	MinBalance *big.Int
+	MinBlock   uint64
+	MaxBalance *big.Int
+	MaxBlock   uint64
+	sumBalance *big.Int
+
+	Incoming *big.Int // value received by transactions
+	Outgoing *big.Int // value sent by transactions
+	Fees     *big.Int // gas paid for the transactions sent
+	Rewards  *big.Int // block, uncle and tip rewards as miner
+	Sent     int
+	Received int
+}
+
+func newAggregate(from uint64, to uint64) *Aggregate {
+	return &Aggregate{From: from, To: to, sumBalance: new(big.Int),
+		Incoming: new(big.Int), Outgoing: new(big.Int), Fees: new(big.Int), Rewards: new(big.Int)}
+}
+
+// AverageBalance returns the mean of the balances at the end of every block,
+// rounded down.
+func (a *Aggregate) AverageBalance() *big.Int {
+	if a.Blocks == 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(a.sumBalance, big.NewInt(int64(a.Blocks)))
+}
+
+func (a *Aggregate) addState(s BlockState) error {
+	if a.Blocks == 0 || s.Balance.Cmp(a.MinBalance) < 0 {
+		a.MinBalance, a.MinBlock = s.Balance, s.Number
+	}
+	if a.Blocks == 0 || s.Balance.Cmp(a.MaxBalance) > 0 {
+		a.MaxBalance, a.MaxBlock = s.Balance, s.Number
+	}
+	a.sumBalance.Add(a.sumBalance, s.Balance)
+	a.Blocks++
+	return nil
+}
+
+func (a *Aggregate) addEvent(ev replayEvent) {
+	if ev.Synced {
+		return
+	}
+	if ev.Tx == (common.Hash{}) {
+		a.Rewards.Add(a.Rewards, ev.Delta)
+		return
+	}
+	a.Incoming.Add(a.Incoming, ev.In)
+	a.Outgoing.Add(a.Outgoing, ev.Out)
+	a.Fees.Add(a.Fees, ev.Fee)
+	// A self transfer counts on both sides
+	if ev.Sent {
+		a.Sent++
+	}
+	if ev.Received {
+		a.Received++
+	}
+}
+
+func (a *Aggregate) print(account common.Address) {
+	fmt.Printf("Account %v over blocks [%d, %d], %d blocks:\n", account, a.From, a.To, a.Blocks)
+	fmt.Printf("Balance min: %v (block %d), max: %v (block %d), average: %v.\n",
+		a.MinBalance, a.MinBlock, a.MaxBalance, a.MaxBlock, a.AverageBalance())
+	fmt.Printf("Incoming: %v in %d txs, outgoing: %v in %d txs, fees: %v, rewards: %v.\n",
+		a.Incoming, a.Received, a.Outgoing, a.Sent, a.Fees, a.Rewards)
+}
+
+// AggregateRange computes the aggregate of account over [from, to] with the
+// checkpoint plus replay engine of PrunedRange, folding every state and change
+// in as it is replayed instead of keeping them.
+func AggregateRange(src *ChainSource, sched schedule, account common.Address, from uint64, to uint64) (*Aggregate, error) {
+	a := newAggregate(from, to)
+	if err := prunedReplay(src, sched, account, from, to, a.addEvent, a.addState); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// doAggregate runs "query aggregate account interval begin end".
+func doAggregate(cmdline []string) {
+	fs := newFlagSet("query aggregate")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 4 {
+		fmt.Println("Error! Must indicate the account hash, the block interval (or manifest), and start/end block number.")
+		return
+	}
+	sched, err := parseSchedule(cmdline[1])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[2], cmdline[3])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	src.printHead()
+	if err := preflightCheckpoints(src, sched, upNum, endNum); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	// Regenerate pruned windows invalidated by a reorg before relying on them
+	if err := refreshWindows(src, upNum, endNum); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	fmt.Println("----------------------Aggregate Query----------------------")
+	startTime := time.Now()
+	account := common.HexToAddress(cmdline[0])
+	a, err := AggregateRange(src, sched, account, uint64(upNum), uint64(endNum))
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	a.print(account)
+	fmt.Printf("Total query time: %d us.\n", time.Since(startTime)/time.Microsecond)
+	src.cache.printStats()
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestAggregateRange(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	addr := c.addrs[0]
+	a, err := AggregateRange(c.src, fixedSchedule(5), addr, 3, 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []BlockState
+	err = OriginRange(c.src, addr, 2, 18, false, func(s BlockState) error {
+		states = append(states, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, states := states[0], states[1:]
+	min, max, sum := states[0].Balance, states[0].Balance, new(big.Int)
+	for _, s := range states {
+		if s.Balance.Cmp(min) < 0 {
+			min = s.Balance
+		}
+		if s.Balance.Cmp(max) > 0 {
+			max = s.Balance
+		}
+		sum.Add(sum, s.Balance)
+	}
+	avg := sum.Div(sum, big.NewInt(int64(len(states))))
+	if a.Blocks != 16 || a.MinBalance.Cmp(min) != 0 || a.MaxBalance.Cmp(max) != 0 || a.AverageBalance().Cmp(avg) != 0 {
+		t.Errorf("balances: got %d blocks min %v max %v avg %v, want 16 blocks min %v max %v avg %v",
+			a.Blocks, a.MinBalance, a.MaxBalance, a.AverageBalance(), min, max, avg)
+	}
+	// Every block has account 0 send twice and receive once
+	if a.Sent != 32 || a.Received != 16 {
+		t.Errorf("transactions: got %d sent and %d received, want 32 and 16", a.Sent, a.Received)
+	}
+	flow := new(big.Int).Add(before.Balance, a.Incoming)
+	flow.Sub(flow, a.Outgoing)
+	flow.Sub(flow, a.Fees)
+	flow.Add(flow, a.Rewards)
+	if last := states[len(states)-1].Balance; flow.Cmp(last) != 0 {
+		t.Errorf("flows don't add up: %v + in - out - fees + rewards = %v, balance is %v", before.Balance, flow, last)
+	}
+	if a.Fees.Sign() == 0 {
+		t.Error("no fees counted")
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// The query caches are bounded by entries, not bytes. Only the trie node cache
+// has a memory limit; a cached account takes around 200 bytes, while a cached
+// trie keeps the nodes queries resolved through it and grows with the number of
+// accounts read from its state.
+var (
+	// trieCacheEntries is the number of opened state tries kept, 0 disables the cache
+	trieCacheEntries = 64
+	// accountCacheEntries is the number of resolved accounts kept, 0 disables the cache
+	accountCacheEntries = 1 << 16
+	// nodeCacheSize is the memory in MB for clean trie nodes in the trie database
+	nodeCacheSize = 256
+)
+
+// cacheStats counts the lookups of one cache.
+type cacheStats struct {
+	Hits, Misses uint64
+}
+
+func (s cacheStats) String() string {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return "unused"
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.1f%% hit rate)", s.Hits, s.Misses, 100*float64(s.Hits)/float64(total))
+}
+
+// accountKey identifies an account in one state.
+type accountKey struct {
+	root common.Hash
+	addr common.Address
+}
+
+// queryCache keeps the state tries and accounts queries resolved, so the
+// queries of one window open their checkpoint trie and walk it to an account
+// once. Tries are never modified through the cache, callers get copies.
+type queryCache struct {
+	tries    *lru.Cache // state root -> *trie.StateTrie
+	accounts *lru.Cache // accountKey -> *types.StateAccount, nil if absent
+
+	TrieStats    cacheStats
+	AccountStats cacheStats
+}
+
+func newQueryCache() (*queryCache, error) {
+	c := new(queryCache)
+	var err error
+	if trieCacheEntries > 0 {
+		if c.tries, err = lru.New(trieCacheEntries); err != nil {
+			return nil, err
+		}
+	}
+	if accountCacheEntries > 0 {
+		if c.accounts, err = lru.New(accountCacheEntries); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// stateTrie returns the state trie of root, opening it on a miss.
+func (c *queryCache) stateTrie(triedb *trie.Database, root common.Hash) (*trie.StateTrie, error) {
+	if c.tries == nil {
+		return trie.NewStateTrie(common.Hash{}, root, triedb)
+	}
+	if cached, ok := c.tries.Get(root); ok {
+		c.TrieStats.Hits++
+		return cached.(*trie.StateTrie).Copy(), nil
+	}
+	c.TrieStats.Misses++
+	Trie, err := trie.NewStateTrie(common.Hash{}, root, triedb)
+	if err != nil {
+		return nil, err
+	}
+	c.tries.Add(root, Trie)
+	return Trie.Copy(), nil
+}
+
+// account returns the account of addr in the state of root, calling load on
+// a miss. Absent accounts are cached as nil.
+func (c *queryCache) account(root common.Hash, addr common.Address, load func() (*types.StateAccount, error)) (*types.StateAccount, error) {
+	if c.accounts == nil {
+		return load()
+	}
+	key := accountKey{root, addr}
+	if cached, ok := c.accounts.Get(key); ok {
+		c.AccountStats.Hits++
+		return copyAccount(cached.(*types.StateAccount)), nil
+	}
+	c.AccountStats.Misses++
+	acc, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.accounts.Add(key, acc)
+	return copyAccount(acc), nil
+}
+
+// copyAccount copies acc so a caller can't change the cached one.
+func copyAccount(acc *types.StateAccount) *types.StateAccount {
+	if acc == nil {
+		return nil
+	}
+	cpy := *acc
+	if acc.Balance != nil {
+		cpy.Balance = new(big.Int).Set(acc.Balance)
+	}
+	cpy.CodeHash = common.CopyBytes(acc.CodeHash)
+	return &cpy
+}
+
+// reset empties both caches and their counters.
+func (c *queryCache) reset() {
+	if c.tries != nil {
+		c.tries.Purge()
+	}
+	if c.accounts != nil {
+		c.accounts.Purge()
+	}
+	c.TrieStats, c.AccountStats = cacheStats{}, cacheStats{}
+}
+
+// printStats prints the lookups of both caches.
+func (c *queryCache) printStats() {
+	fmt.Printf("Trie cache: %v. Account cache: %v.\n", c.TrieStats, c.AccountStats)
+}
@@ -0,0 +1,63 @@
+package utils
+
+import "testing"
+
+func TestQueryCacheServesRepeatedQueries(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	addr := c.addrs[0].Hex()
+	first, err := prunedPointQuery(c.src, fixedSchedule(5), addr, 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := c.src.cache.TrieStats
+	if stats.Hits == 0 {
+		t.Error("queries in the same window reopened their checkpoint trie")
+	}
+	second, err := prunedPointQuery(c.src, fixedSchedule(5), addr, 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.src.cache.TrieStats.Misses != stats.Misses {
+		t.Errorf("repeated query missed the trie cache %d times", c.src.cache.TrieStats.Misses-stats.Misses)
+	}
+	if c.src.cache.AccountStats.Hits == 0 {
+		t.Error("repeated query never hit the account cache")
+	}
+	for n, want := range first {
+		if got := second[n]; got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce {
+			t.Errorf("block %d: cached answer %+v, first answer %+v", n, got, want)
+		}
+	}
+}
+
+func TestQueryCacheReturnsCopies(t *testing.T) {
+	c := newTestChain(t, busyTransfers(2))
+	_, Trie, err := openState(c.src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := readAccount(c.src, Trie, c.addrs[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := acc.Balance.String()
+	acc.Balance.SetInt64(0)
+	if err := Trie.TryDeleteAccount(c.addrs[0].Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, Trie, err = openState(c.src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := Trie.TryGetAccount(c.addrs[0].Bytes()); err != nil || acc == nil {
+		t.Fatalf("a change to a returned trie reached the cache: %v, %v", acc, err)
+	}
+	acc, err = readAccount(c.src, Trie, c.addrs[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance.String() != want {
+		t.Errorf("a change to a returned account reached the cache: balance %v, want %v", acc.Balance, want)
+	}
+}
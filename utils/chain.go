@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var (
+	// network selects the chain rules, "auto" reads them from the genesis in the database
+	network = "auto"
+	// chainConfig holds the rules of the chain being pruned or queried
+	chainConfig = params.MainnetChainConfig
+
+	// holeskyChainConfig is not shipped with the go-ethereum version we build against
+	holeskyChainConfig = &params.ChainConfig{
+		ChainID:                       big.NewInt(17000),
+		HomesteadBlock:                big.NewInt(0),
+		EIP150Block:                   big.NewInt(0),
+		EIP155Block:                   big.NewInt(0),
+		EIP158Block:                   big.NewInt(0),
+		ByzantiumBlock:                big.NewInt(0),
+		ConstantinopleBlock:           big.NewInt(0),
+		PetersburgBlock:               big.NewInt(0),
+		IstanbulBlock:                 big.NewInt(0),
+		BerlinBlock:                   big.NewInt(0),
+		LondonBlock:                   big.NewInt(0),
+		TerminalTotalDifficulty:       big.NewInt(0),
+		TerminalTotalDifficultyPassed: true,
+		Ethash:                        new(params.EthashConfig),
+	}
+
+	// networks holds the built-in rules. They all end at the merge: Shanghai
+	// and the later forks are scheduled by time on every network, which
+	// go-ethereum v1.10 can't express. Blocks past Shanghai are replayed with
+	// the merge rules, so withdrawals show up as missed credits, and witnesses
+	// of blocks using newer opcodes don't execute.
+	networks = map[string]*params.ChainConfig{
+		"mainnet": params.MainnetChainConfig,
+		"goerli":  params.GoerliChainConfig,
+		"sepolia": params.SepoliaChainConfig,
+		"holesky": holeskyChainConfig,
+	}
+
+	// explorers maps chain IDs to the block explorer printed while pruning
+	explorers = map[uint64]string{
+		1:        "https://etherscan.io/block/",
+		5:        "https://goerli.etherscan.io/block/",
+		17000:    "https://holesky.etherscan.io/block/",
+		11155111: "https://sepolia.etherscan.io/block/",
+	}
+)
+
+// loadChainConfig sets chainConfig from the network flag, or from the genesis
+// stored in the database when the network is "auto" or "dev". A dev chain runs
+// whatever consensus its genesis chose, so it has no built-in rules.
+func loadChainConfig(db ethdb.Reader) error {
+	if network != "auto" && network != "dev" {
+		config, ok := networks[network]
+		if !ok {
+			return fmt.Errorf("unknown network %q", network)
+		}
+		chainConfig = config
+		return nil
+	}
+	if db == nil {
+		return fmt.Errorf("no database to read the %s chain rules from, use one of -network %s", network, strings.Join(networkNames(), ", "))
+	}
+	genesis := rawdb.ReadCanonicalHash(db, 0)
+	if genesis == (common.Hash{}) {
+		return &BlockMissingError{Number: 0, Part: "hash"}
+	}
+	// ReadChainConfig retrieves the consensus settings based on the given genesis hash.
+	config := rawdb.ReadChainConfig(db, genesis)
+	if config == nil {
+		return fmt.Errorf("no chain config stored for genesis %x, use -network", genesis)
+	}
+	chainConfig = config
+	fmt.Printf("Chain ID: %v\n", chainConfig.ChainID)
+	return nil
+}
+
+// networkNames returns the networks with built-in rules, sorted.
+func networkNames() []string {
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// explorerURL returns the block explorer link of block number, or "" if the
+// chain has no public explorer.
+func explorerURL(number uint64) string {
+	prefix, ok := explorers[chainConfig.ChainID.Uint64()]
+	if !ok {
+		return ""
+	}
+	return prefix + fmt.Sprint(number)
+}
+
+// txFee returns what the sender of a plain transfer pays for gas, following the
+// EIP-1559 effective price once London is active.
+func txFee(tx *types.Transaction, header *types.Header) *big.Int {
+	price := tx.GasPrice()
+	if chainConfig.IsLondon(header.Number) && header.BaseFee != nil {
+		tip, _ := tx.EffectiveGasTip(header.BaseFee)
+		price = new(big.Int).Add(header.BaseFee, tip)
+	}
+	return new(big.Int).Mul(price, big.NewInt(21000))
+}
+
+// txTip returns the part of the fee of a plain transfer that goes to the coinbase.
+func txTip(tx *types.Transaction, header *types.Header) *big.Int {
+	if !chainConfig.IsLondon(header.Number) || header.BaseFee == nil {
+		return txFee(tx, header)
+	}
+	tip, _ := tx.EffectiveGasTip(header.BaseFee)
+	if tip.Sign() < 0 {
+		tip = new(big.Int)
+	}
+	return new(big.Int).Mul(tip, big.NewInt(21000))
+}
+
+// blockReward returns the consensus reward credited to account in the block:
+// the static and uncle inclusion rewards for the miner and the reward of each
+// uncle miner. Clique and post-merge blocks carry no reward.
+func blockReward(header *types.Header, uncles []*types.Header, account common.Address) *big.Int {
+	total := new(big.Int)
+	if chainConfig.Clique != nil || header.Difficulty == nil || header.Difficulty.Sign() == 0 {
+		return total
+	}
+	// Select the correct block reward based on chain progression
+	reward := ethash.FrontierBlockReward
+	if chainConfig.IsByzantium(header.Number) {
+		reward = ethash.ByzantiumBlockReward
+	}
+	if chainConfig.IsConstantinople(header.Number) {
+		reward = ethash.ConstantinopleBlockReward
+	}
+	if header.Coinbase == account {
+		total.Add(total, reward)
+	}
+	for _, uncle := range uncles {
+		if header.Coinbase == account {
+			total.Add(total, new(big.Int).Div(reward, big.NewInt(32)))
+		}
+		if uncle.Coinbase == account {
+			r := new(big.Int).Add(uncle.Number, big.NewInt(8))
+			r.Sub(r, header.Number)
+			r.Mul(r, reward)
+			r.Div(r, big.NewInt(8))
+			total.Add(total, r)
+		}
+	}
+	return total
+}
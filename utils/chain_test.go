@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// testChain is a small synthetic chain generated into an in-memory database.
+type testChain struct {
+	db     ethdb.Database
+	src    *ChainSource
+	keys   []*ecdsa.PrivateKey
+	addrs  []common.Address
+	miner  common.Address
+	blocks []*types.Block
+}
+
+// transfer describes a plain value transfer between two test accounts.
+type transfer struct {
+	from, to int
+	value    int64
+}
+
+// newTestChain generates len(txs) blocks on top of a genesis funding four
+// accounts. Block i+1 contains the transfers txs[i]. The deleted-account files
+// and the manifest go to a temporary directory.
+func newTestChain(t testing.TB, txs [][]transfer) *testChain {
+	t.Helper()
+
+	deletedDir = t.TempDir()
+	network, onMissing = "auto", policyStop
+
+	c := &testChain{db: rawdb.NewMemoryDatabase(), miner: common.HexToAddress("0xc0ffee")}
+	alloc := core.GenesisAlloc{}
+	for i := 0; i < 4; i++ {
+		key, _ := crypto.GenerateKey()
+		c.keys = append(c.keys, key)
+		c.addrs = append(c.addrs, crypto.PubkeyToAddress(key.PublicKey))
+		alloc[c.addrs[i]] = core.GenesisAccount{Balance: big.NewInt(params.Ether)}
+	}
+	genesis := (&core.Genesis{Config: params.TestChainConfig, Alloc: alloc, BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(c.db)
+
+	c.blocks = c.extend(t, genesis, txs)
+
+	src, err := NewChainSource(c.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.src = src
+	return c
+}
+
+// extend generates len(txs) blocks on top of parent and makes them canonical,
+// replacing whatever was canonical at those heights before.
+func (c *testChain) extend(t testing.TB, parent *types.Block, txs [][]transfer) []*types.Block {
+	t.Helper()
+
+	config := params.TestChainConfig
+	signer := types.LatestSigner(config)
+	blocks, _ := core.GenerateChain(config, parent, ethash.NewFaker(), c.db, len(txs), func(i int, b *core.BlockGen) {
+		b.SetCoinbase(c.miner)
+		for _, tr := range txs[i] {
+			tx := types.NewTransaction(b.TxNonce(c.addrs[tr.from]), c.addrs[tr.to], big.NewInt(tr.value), params.TxGas, big.NewInt(2*params.GWei), nil)
+			signed, err := types.SignTx(tx, signer, c.keys[tr.from])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.AddTx(signed)
+		}
+	})
+	for _, block := range blocks {
+		rawdb.WriteBlock(c.db, block)
+		rawdb.WriteCanonicalHash(c.db, block.Hash(), block.NumberU64())
+	}
+	head := blocks[len(blocks)-1]
+	rawdb.WriteHeadHeaderHash(c.db, head.Hash())
+	rawdb.WriteHeadBlockHash(c.db, head.Hash())
+	return blocks
+}
+
+// dropState deletes the root node of the state of block number, as a pruning
+// geth would.
+func (c *testChain) dropState(number uint64) {
+	c.db.Delete(c.blocks[number-1].Root().Bytes())
+}
+
+// dropHeader deletes the header of block number, keeping its canonical hash.
+func (c *testChain) dropHeader(number uint64) {
+	block := c.blocks[number-1]
+	rawdb.DeleteHeader(c.db, block.Hash(), number)
+}
+
+// dropBody deletes the body of block number.
+func (c *testChain) dropBody(number uint64) {
+	block := c.blocks[number-1]
+	rawdb.DeleteBody(c.db, block.Hash(), number)
+}
+
+// busyTransfers returns n blocks in which every account sends to the next one
+// and account 0 sends a second time, so senders repeat inside each window.
+func busyTransfers(n int) [][]transfer {
+	txs := make([][]transfer, n)
+	for i := range txs {
+		txs[i] = []transfer{{0, 1, 1000}, {1, 2, 2000}, {2, 3, 3000}, {3, 0, 4000}, {0, 2, int64(i)}}
+	}
+	return txs
+}
+
+// newForwarderChain generates five blocks in which the recipient is only paid
+// through a contract, which replay can't see, and then spends part of it:
+// block 1 calls the forwarder with 0.5 ether, block 2 has the recipient send
+// 0.4 ether back. It returns the source and the recipient.
+func newForwarderChain(t testing.TB) (*ChainSource, common.Address) {
+	t.Helper()
+
+	deletedDir = t.TempDir()
+	network, onMissing = "auto", policyStop
+
+	db := rawdb.NewMemoryDatabase()
+	sender, _ := crypto.GenerateKey()
+	recipient, _ := crypto.GenerateKey()
+	senderAddr, recipientAddr := crypto.PubkeyToAddress(sender.PublicKey), crypto.PubkeyToAddress(recipient.PublicKey)
+	forwarder := common.HexToAddress("0xf0")
+	// CALL(gas, recipient, callvalue, 0, 0, 0, 0)
+	code := append([]byte{0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, 0x34, 0x73}, recipientAddr.Bytes()...)
+	code = append(code, 0x5a, 0xf1, 0x00)
+	alloc := core.GenesisAlloc{
+		senderAddr: {Balance: big.NewInt(params.Ether)},
+		forwarder:  {Balance: new(big.Int), Code: code},
+	}
+	genesis := (&core.Genesis{Config: params.TestChainConfig, Alloc: alloc, BaseFee: big.NewInt(params.InitialBaseFee)}).MustCommit(db)
+
+	signer := types.LatestSigner(params.TestChainConfig)
+	blocks, _ := core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), db, 5, func(i int, b *core.BlockGen) {
+		var tx *types.Transaction
+		switch i {
+		case 0:
+			tx, _ = types.SignTx(types.NewTransaction(0, forwarder, big.NewInt(params.Ether/2), 100000, big.NewInt(2*params.GWei), nil), signer, sender)
+		case 1:
+			tx, _ = types.SignTx(types.NewTransaction(0, senderAddr, big.NewInt(params.Ether/10*4), params.TxGas, big.NewInt(2*params.GWei), nil), signer, recipient)
+		default:
+			return
+		}
+		b.AddTx(tx)
+	})
+	for _, block := range blocks {
+		rawdb.WriteBlock(db, block)
+		rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+	}
+	rawdb.WriteHeadHeaderHash(db, blocks[4].Hash())
+	rawdb.WriteHeadBlockHash(db, blocks[4].Hash())
+
+	src, err := NewChainSource(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, recipientAddr
+}
+
+func TestLoadChainConfig(t *testing.T) {
+	t.Cleanup(func() { network, chainConfig = "auto", params.MainnetChainConfig })
+	db := rawdb.NewMemoryDatabase()
+	(&core.Genesis{Config: params.AllEthashProtocolChanges}).MustCommit(db)
+
+	for _, tc := range []struct {
+		network string
+		chainID int64
+	}{
+		// The stored genesis of a dev chain
+		{"auto", 1337},
+		{"dev", 1337},
+		// The flag wins over the genesis
+		{"mainnet", 1},
+		{"sepolia", 11155111},
+		{"holesky", 17000},
+	} {
+		network = tc.network
+		if err := loadChainConfig(db); err != nil {
+			t.Fatalf("%s: %v", tc.network, err)
+		}
+		if chainConfig.ChainID.Int64() != tc.chainID {
+			t.Errorf("%s: chain ID %v, want %d", tc.network, chainConfig.ChainID, tc.chainID)
+		}
+	}
+	// The rules loaded last are holesky's
+	if explorerURL(5) != "https://holesky.etherscan.io/block/5" {
+		t.Errorf("holesky explorer link %q", explorerURL(5))
+	}
+
+	network = "ropsten"
+	if err := loadChainConfig(db); err == nil {
+		t.Error("unknown network loaded")
+	}
+	// Without a database only the built-in rules are there
+	for _, network = range []string{"auto", "dev"} {
+		if err := loadChainConfig(nil); err == nil {
+			t.Errorf("%s rules loaded without a database", network)
+		}
+	}
+	network = "auto"
+	if err := loadChainConfig(rawdb.NewMemoryDatabase()); !errors.Is(err, ErrBlockMissing) {
+		t.Errorf("empty database gives %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DeletedAccounts is what the deleted-account files of the manifest say:
+// which accounts prune deleted from the trie of which block.
+type DeletedAccounts struct {
+	blocks map[uint64][]common.Address
+}
+
+// AddressCount is an address with the number of blocks it was deleted in.
+type AddressCount struct {
+	Address common.Address
+	Count   int
+}
+
+// readDeletedFile reads a deleted-account file into its lines, one per block
+// in file order, each with the addresses before its BLKEND.
+func readDeletedFile(path string) ([][]common.Address, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines [][]common.Address
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[len(fields)-1] != "BLKEND" {
+			return nil, fmt.Errorf("%s line %d: no BLKEND, the file is truncated or corrupted", path, n)
+		}
+		line := make([]common.Address, 0, len(fields)-1)
+		for _, field := range fields[:len(fields)-1] {
+			if !common.IsHexAddress(field) {
+				return nil, fmt.Errorf("%s line %d: %q is not an address", path, n, field)
+			}
+			line = append(line, common.HexToAddress(field))
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// LoadDeletedAccounts reads the deleted-account file of every window in the
+// manifest. The lines are matched to blocks by the manifest entries, the
+// checkpoint first and then the pruned blocks downwards.
+func LoadDeletedAccounts() (*DeletedAccounts, error) {
+	m, err := loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Windows) == 0 {
+		return nil, fmt.Errorf("no pruned windows in %s", manifestPath())
+	}
+	d := &DeletedAccounts{blocks: map[uint64][]common.Address{}}
+	for cp, w := range m.Windows {
+		lines, err := readDeletedFile(w.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) != len(w.Blocks)+1 {
+			return nil, fmt.Errorf("window %d: %d lines in %s, manifest lists %d blocks", cp, len(lines), w.File, len(w.Blocks)+1)
+		}
+		for i, blk := range w.Blocks {
+			if len(lines[i+1]) > 0 {
+				d.blocks[blk.Number] = lines[i+1]
+			}
+		}
+	}
+	return d, nil
+}
+
+// PrunedAt reports whether addr was deleted from the trie of block number.
+func (d *DeletedAccounts) PrunedAt(addr common.Address, number uint64) bool {
+	for _, acc := range d.blocks[number] {
+		if acc == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Deleted returns the accounts deleted from the trie of block number.
+func (d *DeletedAccounts) Deleted(number uint64) []common.Address {
+	return d.blocks[number]
+}
+
+// PrunedBlocks returns the blocks addr was deleted from, in ascending order.
+func (d *DeletedAccounts) PrunedBlocks(addr common.Address) []uint64 {
+	var blocks []uint64
+	for number, accs := range d.blocks {
+		for _, acc := range accs {
+			if acc == addr {
+				blocks = append(blocks, number)
+				break
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// Top returns the n addresses deleted from the most blocks.
+func (d *DeletedAccounts) Top(n int) []AddressCount {
+	counts := map[common.Address]int{}
+	for _, accs := range d.blocks {
+		for _, acc := range accs {
+			counts[acc]++
+		}
+	}
+	top := make([]AddressCount, 0, len(counts))
+	for acc, count := range counts {
+		top = append(top, AddressCount{acc, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Address.Hex() < top[j].Address.Hex()
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// checkDeletedFiles validates the file of every window in the manifest: it
+// must parse, have one BLKEND line per block of the window as the manifest and
+// the window size say, and nothing deleted from the checkpoint itself.
+func checkDeletedFiles(m *manifest) []error {
+	var cps []uint64
+	for cp := range m.Windows {
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i] < cps[j] })
+
+	var problems []error
+	for _, cp := range cps {
+		w := m.Windows[cp]
+		lines, err := readDeletedFile(w.File)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("window %d: %v", cp, err))
+			continue
+		}
+		if size := int(cp - w.low() + 1); len(lines) != size || len(lines) != len(w.Blocks)+1 {
+			problems = append(problems, fmt.Errorf("window %d: %d BLKEND lines, the window has %d blocks and the manifest lists %d",
+				cp, len(lines), size, len(w.Blocks)+1))
+			continue
+		}
+		if len(lines[0]) > 0 {
+			problems = append(problems, fmt.Errorf("window %d: %d accounts deleted from the checkpoint", cp, len(lines[0])))
+		}
+		deleted := 0
+		for _, line := range lines {
+			deleted += len(line)
+		}
+		if deleted != w.Deleted {
+			problems = append(problems, fmt.Errorf("window %d: %d deletions in the file, manifest counts %d", cp, deleted, w.Deleted))
+		}
+	}
+	return problems
+}
+
+// doInspectDeleted runs "inspect deleted", which reads the deleted-account
+// files instead of the chain.
+func doInspectDeleted(cmdline []string) {
+	fs := newFlagSet("inspect deleted")
+	addrHex := fs.String("address", "", "list the blocks this address was deleted from, or with -block whether it was")
+	block := fs.String("block", "", "list the accounts deleted from this block")
+	top := fs.Int("top", 0, "list the addresses deleted from the most blocks")
+	check := fs.Bool("check", false, "validate every deleted-account file against the manifest")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+
+	if *check {
+		m, err := loadManifest()
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		problems := checkDeletedFiles(m)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		fmt.Printf("Checked %d windows: %d problems.\n", len(m.Windows), len(problems))
+		if len(problems) > 0 {
+			return
+		}
+	}
+
+	d, err := LoadDeletedAccounts()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	var number uint64
+	if *block != "" {
+		if number, err = strconv.ParseUint(*block, 10, 64); err != nil {
+			fmt.Printf("Error! Block %q is not a block number.\n", *block)
+			return
+		}
+	}
+	switch {
+	case *addrHex != "" && *block != "":
+		addr := common.HexToAddress(*addrHex)
+		fmt.Printf("Account %v pruned at block %d: %v\n", addr, number, d.PrunedAt(addr, number))
+	case *addrHex != "":
+		addr := common.HexToAddress(*addrHex)
+		blocks := d.PrunedBlocks(addr)
+		fmt.Printf("Account %v was deleted from %d blocks: %v\n", addr, len(blocks), blocks)
+	case *block != "":
+		accs := d.Deleted(number)
+		fmt.Printf("Block %d deleted %d accounts.\n", number, len(accs))
+		for _, acc := range accs {
+			fmt.Println(acc)
+		}
+	}
+	if *top > 0 {
+		fmt.Printf("Top %d pruned addresses:\n", *top)
+		for _, c := range d.Top(*top) {
+			fmt.Printf("%v %d\n", c.Address, c.Count)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDeletedAccounts(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadDeletedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := loadManifest()
+	if problems := checkDeletedFiles(m); len(problems) != 0 {
+		t.Fatalf("fresh files have problems: %v", problems)
+	}
+
+	// The reader agrees with the raw lines, checkpoint first and then downwards
+	counts := map[common.Address]int{}
+	for cp, w := range m.Windows {
+		lines := readDeletedLines(t, int(cp))
+		for i, blk := range w.Blocks {
+			if len(d.Deleted(blk.Number)) != len(lines[i+1]) {
+				t.Errorf("block %d: reader has %d deletions, file %d", blk.Number, len(d.Deleted(blk.Number)), len(lines[i+1]))
+			}
+			for _, acc := range lines[i+1] {
+				addr := common.HexToAddress(acc)
+				counts[addr]++
+				if !d.PrunedAt(addr, blk.Number) {
+					t.Errorf("%v not pruned at block %d", addr, blk.Number)
+				}
+			}
+		}
+		if len(d.Deleted(cp)) != 0 {
+			t.Errorf("checkpoint %d has deletions", cp)
+		}
+	}
+	if len(counts) == 0 {
+		t.Fatal("nothing was pruned")
+	}
+	top := d.Top(1)
+	for addr, n := range counts {
+		if n > top[0].Count {
+			t.Errorf("top address %v deleted %d times, %v %d times", top[0].Address, top[0].Count, addr, n)
+		}
+	}
+	if blocks := d.PrunedBlocks(top[0].Address); len(blocks) != top[0].Count {
+		t.Errorf("top address pruned in %d blocks, counted %d", len(blocks), top[0].Count)
+	}
+}
+
+func TestCheckDeletedFiles(t *testing.T) {
+	c := newTestChain(t, busyTransfers(10))
+	if err := prune(c.src, fixedSchedule(5), 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := loadManifest()
+
+	// A window file losing its last line is one block short
+	data, err := os.ReadFile(deletedFile(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := data[:len(data)-1]
+	for len(short) > 0 && short[len(short)-1] != '\n' {
+		short = short[:len(short)-1]
+	}
+	if err := os.WriteFile(deletedFile(10), short, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkDeletedFiles(m); len(problems) != 1 {
+		t.Errorf("truncated window: problems %v", problems)
+	}
+	if _, err := LoadDeletedAccounts(); err == nil {
+		t.Error("truncated window loaded")
+	}
+
+	// A line cut before its BLKEND doesn't parse
+	if err := os.WriteFile(deletedFile(10), append(short, "0x00000000000000000000000000000000000000c1"...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkDeletedFiles(m); len(problems) != 1 {
+		t.Errorf("unterminated line: problems %v", problems)
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	// ErrBlockMissing is matched by every error about a block whose hash,
+	// header or body is not in the database.
+	ErrBlockMissing = errors.New("block missing")
+	// ErrStateMissing is matched by every error about a state root whose trie
+	// nodes are gone, typically because geth pruned them.
+	ErrStateMissing = errors.New("state missing")
+	// ErrAccountAbsent is matched by every error about an account that does not
+	// exist in the requested state.
+	ErrAccountAbsent = errors.New("account absent")
+	// ErrNonceGap is matched by every error about a replayed transaction whose
+	// nonce doesn't follow the account's, a sign of skipped blocks or corrupt data.
+	ErrNonceGap = errors.New("nonce gap")
+	// ErrMissedCredit is matched by every error about a replayed debit the
+	// balance can't cover. Replay only models plain transfers, so on mainnet
+	// this usually means the account received value inside a contract call.
+	ErrMissedCredit = errors.New("missed credit")
+	// ErrInvalidProof is matched by every error about a state proof that fails
+	// one of its checks.
+	ErrInvalidProof = errors.New("invalid proof")
+)
+
+// BlockMissingError reports which part of a canonical block could not be read.
+type BlockMissingError struct {
+	Number uint64
+	Part   string // "hash", "header" or "body"
+}
+
+func (e *BlockMissingError) Error() string {
+	return fmt.Sprintf("block %d missing: no %s", e.Number, e.Part)
+}
+
+func (e *BlockMissingError) Is(target error) bool { return target == ErrBlockMissing }
+
+// StateMissingError reports a state trie that cannot be resolved.
+type StateMissingError struct {
+	Number uint64
+	Root   common.Hash
+	Err    error
+}
+
+func (e *StateMissingError) Error() string {
+	return fmt.Sprintf("state of block %d (root %x) missing: %v", e.Number, e.Root, e.Err)
+}
+
+func (e *StateMissingError) Is(target error) bool { return target == ErrStateMissing }
+
+func (e *StateMissingError) Unwrap() error { return e.Err }
+
+// AccountAbsentError reports an account that is not present in a state trie.
+type AccountAbsentError struct {
+	Number  uint64
+	Address common.Address
+}
+
+func (e *AccountAbsentError) Error() string {
+	return fmt.Sprintf("account %v absent in block %d", e.Address, e.Number)
+}
+
+func (e *AccountAbsentError) Is(target error) bool { return target == ErrAccountAbsent }
+
+// NonceGapError reports a transaction replayed out of nonce order.
+type NonceGapError struct {
+	Number  uint64
+	Tx      common.Hash
+	Address common.Address
+	Want    uint64 // nonce the replayed account is at
+	Got     uint64 // nonce carried by the transaction
+}
+
+func (e *NonceGapError) Error() string {
+	return fmt.Sprintf("nonce gap in block %d: tx %x of %v has nonce %d, replay expected %d", e.Number, e.Tx, e.Address, e.Got, e.Want)
+}
+
+func (e *NonceGapError) Is(target error) bool { return target == ErrNonceGap }
+
+// missingPolicy decides what prune and query do when data is missing.
+type missingPolicy int
+
+const (
+	policyStop     missingPolicy = iota // abort the run with the error
+	policySkip                          // report the error and skip the block
+	policyFallback                      // use the nearest available state instead
+)
+
+var (
+	onMissing     = policyStop
+	fallbackDepth = 128
+)
+
+func (p *missingPolicy) String() string {
+	switch *p {
+	case policySkip:
+		return "skip"
+	case policyFallback:
+		return "fallback"
+	default:
+		return "stop"
+	}
+}
+
+func (p *missingPolicy) Set(s string) error {
+	switch s {
+	case "stop":
+		*p = policyStop
+	case "skip":
+		*p = policySkip
+	case "fallback":
+		*p = policyFallback
+	default:
+		return fmt.Errorf("unknown policy %q, must be stop, skip or fallback", s)
+	}
+	return nil
+}
+
+// isMissing reports whether err is one of the missing-data errors the policy applies to.
+func isMissing(err error) bool {
+	return errors.Is(err, ErrBlockMissing) || errors.Is(err, ErrStateMissing) || errors.Is(err, ErrAccountAbsent) ||
+		errors.Is(err, ErrMissedCredit)
+}
+
+// tolerate applies the policy to err: it returns nil when the caller should
+// skip the item and carry on, and err itself when the run has to stop.
+func tolerate(err error) error {
+	if err == nil || onMissing == policyStop || !isMissing(err) {
+		return err
+	}
+	fmt.Printf("Skip: %v\n", err)
+	return nil
+}
+
+// wrapTrieErr turns a missing trie node into a StateMissingError for block number.
+func wrapTrieErr(err error, number uint64, root common.Hash) error {
+	var missing *trie.MissingNodeError
+	if errors.As(err, &missing) {
+		return &StateMissingError{Number: number, Root: root, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+package utils
+
+import "flag"
+
+// newFlagSet creates the flag set of a sub command with the options shared by
+// all of them. Flags must precede the positional arguments. Begin and end
+// block arguments may also be given as dates, see resolveBlocks.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Var(&onMissing, "on-missing", "what to do with missing blocks, state or accounts: stop, skip or fallback")
+	fs.StringVar(&dbPath, "datadir", dbPath, "chaindata directory of the geth node")
+	fs.StringVar(&ancientPath, "ancient", ancientPath, "ancient store directory, defaults to <datadir>/ancient")
+	fs.StringVar(&deletedDir, "deleted", deletedDir, "directory of the deleted-account files and the manifest")
+	fs.IntVar(&dbCache, "cache", dbCache, "database cache size in MB")
+	fs.IntVar(&handles, "handles", handles, "number of open file handles of the database")
+	fs.BoolVar(&readOnly, "readonly", readOnly, "open the database read-only, e.g. on a snapshot copy")
+	fs.StringVar(&network, "network", network, "chain rules to apply: auto, mainnet, goerli, sepolia, holesky (all up to the merge) or dev (read from the stored genesis like auto)")
+	fs.IntVar(&fallbackDepth, "fallback-depth", fallbackDepth, "how many blocks to search back for available state")
+	fs.IntVar(&trieCacheEntries, "trie-cache-entries", trieCacheEntries, "number of opened state tries queries keep (an entry count, not MB), 0 disables")
+	fs.IntVar(&accountCacheEntries, "account-cache-entries", accountCacheEntries, "number of resolved accounts queries keep (an entry count, not MB), 0 disables")
+	fs.IntVar(&nodeCacheSize, "node-cache", nodeCacheSize, "memory in MB for clean trie nodes")
+	fs.BoolVar(&snapshotReads, "snapshot", snapshotReads, "read accounts from geth's snapshot or flattened checkpoints before the trie")
+	fs.StringVar(&flatDir, "flat-dir", flatDir, "directory of the flattened checkpoint states, defaults to <deleted>/flat")
+	fs.BoolVar(&backwardReplay, "backward", backwardReplay, "replay backward from the next checkpoint when it is closer")
+	fs.StringVar(&timeIndexPath, "time-index", timeIndexPath, "file caching block timestamps for date arguments")
+	return fs
+}
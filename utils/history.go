@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// historyRow is one change point of an account.
+type historyRow struct {
+	Block   uint64      `json:"block"`
+	Tx      common.Hash `json:"tx"`
+	Delta   string      `json:"delta"`
+	Balance string      `json:"balance"`
+	Nonce   uint64      `json:"nonce"`
+}
+
+// historyWriter streams history rows in one output format.
+type historyWriter interface {
+	write(row historyRow) error
+	close() error
+}
+
+type csvHistory struct{ w *csv.Writer }
+
+func (h *csvHistory) write(row historyRow) error {
+	return h.w.Write([]string{fmt.Sprint(row.Block), row.Tx.Hex(), row.Delta, row.Balance, fmt.Sprint(row.Nonce)})
+}
+
+func (h *csvHistory) close() error {
+	h.w.Flush()
+	return h.w.Error()
+}
+
+type jsonHistory struct {
+	w     io.Writer
+	first bool
+}
+
+func (h *jsonHistory) write(row historyRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if h.first {
+		sep, h.first = "[\n", false
+	}
+	_, err = fmt.Fprintf(h.w, "%s  %s", sep, data)
+	return err
+}
+
+func (h *jsonHistory) close() error {
+	if h.first {
+		_, err := fmt.Fprint(h.w, "[")
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(h.w, "\n]\n")
+	return err
+}
+
+func newHistoryWriter(format string, w io.Writer) (historyWriter, error) {
+	switch format {
+	case "csv":
+		h := &csvHistory{w: csv.NewWriter(w)}
+		return h, h.w.Write([]string{"block", "tx", "delta", "balance", "nonce"})
+	case "json":
+		return &jsonHistory{w: w, first: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be csv or json", format)
+	}
+}
+
+// DoHistory prints every change of an account's balance and nonce between two blocks.
+func DoHistory(cmdline []string) {
+	fs := newFlagSet("history")
+	format := fs.String("format", "csv", "output format: csv or json")
+	mode := fs.String("mode", "pruned", "pruned: checkpoints plus replay, origin: the original trie of every block")
+	inter := fs.Int("interval", 0, "checkpoint interval of the pruned mode, defaults to the checkpoints in the manifest")
+	out := fs.String("out", "", "write the rows to this file instead of stdout")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 3 {
+		fmt.Println("Error! Must indicate the account, begin blknum, and end blknum.")
+		return
+	}
+	if *inter < 0 {
+		fmt.Printf("Error! Checkpoint interval %d is not a positive number of blocks.\n", *inter)
+		return
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[1], cmdline[2])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+	hw, err := newHistoryWriter(*format, w)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	account := common.HexToAddress(cmdline[0])
+	switch *mode {
+	case "origin":
+		err = originHistory(src, account, upNum, endNum, hw.write)
+	case "pruned":
+		var sched schedule = fixedSchedule(*inter)
+		if *inter == 0 {
+			m, err := loadManifest()
+			if err != nil || m.checkpoints() == nil {
+				fmt.Println("Error! No pruned manifest, indicate the checkpoint interval.")
+				return
+			}
+			sched = m.checkpoints()
+		}
+		err = prunedHistory(src, sched, account, upNum, endNum, hw.write)
+	default:
+		err = fmt.Errorf("unknown mode %q, must be pruned or origin", *mode)
+	}
+	if err == nil {
+		err = hw.close()
+	}
+	if err != nil {
+		fmt.Println("Error!", err)
+	}
+}
+
+// prunedHistory starts from the checkpoint closer to upNum, reaches upNum
+// silently by forward or backward replay and reports every change until
+// endNum. At each later checkpoint the replayed state is checked against the
+// checkpoint trie, a difference (e.g. from contract internals replay doesn't
+// model) is reported as a row without transaction and the trie value is taken
+// over.
+func prunedHistory(src *ChainSource, sched schedule, account common.Address, upNum int, endNum int, emit func(historyRow) error) error {
+	if err := preflightCheckpoints(src, sched, upNum, endNum); err != nil {
+		return err
+	}
+
+	// Regenerate pruned windows invalidated by a reorg before relying on them
+	if err := refreshWindows(src, upNum, endNum); err != nil {
+		return err
+	}
+
+	var emitErr error
+	report := func(ev replayEvent) {
+		if emitErr == nil {
+			emitErr = emit(historyRow{Block: ev.Block, Tx: ev.Tx, Delta: ev.Delta.String(), Balance: ev.Balance.String(), Nonce: ev.Nonce})
+		}
+	}
+	// A failed write stops the replay at the end of the block
+	stop := func(BlockState) error { return emitErr }
+	if err := prunedReplay(src, sched, account, uint64(upNum), uint64(endNum), report, stop); err != nil {
+		return err
+	}
+	return emitErr
+}
+
+// originHistory reads the account from the original trie of every block and
+// reports the blocks where its balance or nonce changed. The row carries the
+// last transaction of the block that touches the account, if any.
+func originHistory(src *ChainSource, account common.Address, upNum int, endNum int, emit func(historyRow) error) error {
+	var (
+		prevBalance *big.Int
+		prevNonce   uint64
+	)
+	for i := upNum - 1; i <= endNum; i++ {
+		if i < 0 {
+			continue
+		}
+		base, Trie, err := resolveState(src, uint64(i))
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		acc, err := readAccount(src, Trie, account, base)
+		if errors.Is(err, ErrAccountAbsent) {
+			acc, err = emptyAccount(), nil
+		}
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		balance, nonce := acc.Balance, acc.Nonce
+		if prevBalance != nil && (balance.Cmp(prevBalance) != 0 || nonce != prevNonce) {
+			row := historyRow{Block: uint64(i), Delta: new(big.Int).Sub(balance, prevBalance).String(), Balance: balance.String(), Nonce: nonce}
+			if tx, err := lastTouchingTx(src, uint64(i), account); err == nil {
+				row.Tx = tx
+			}
+			if err := emit(row); err != nil {
+				return err
+			}
+		}
+		prevBalance, prevNonce = balance, nonce
+	}
+	return nil
+}
+
+// lastTouchingTx returns the hash of the last transaction of block number that
+// account sends or receives.
+func lastTouchingTx(src *ChainSource, number uint64, account common.Address) (common.Hash, error) {
+	var last common.Hash
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return last, err
+	}
+	blkBody, err := readBody(src.DB, number)
+	if err != nil {
+		return last, err
+	}
+	for _, tx := range blkBody.Transactions {
+		txFrom, err := getFromAddr(tx, blkHeader.Number)
+		if err != nil {
+			return last, err
+		}
+		if txFrom == account || tx.To() != nil && *tx.To() == account {
+			last = tx.Hash()
+		}
+	}
+	return last, nil
+}
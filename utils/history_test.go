@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPrunedHistoryMatchesOrigin(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range append([]common.Address{c.miner}, c.addrs...) {
+		// The last pruned row of a block must land where the origin row does
+		pruned := map[uint64]historyRow{}
+		err := prunedHistory(c.src, fixedSchedule(5), addr, 3, 20, func(row historyRow) error {
+			pruned[row.Block] = row
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		origin := map[uint64]historyRow{}
+		err = originHistory(c.src, addr, 3, 20, func(row historyRow) error {
+			origin[row.Block] = row
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(origin) == 0 {
+			t.Fatalf("%v: no history, the chain doesn't exercise it", addr)
+		}
+		if len(pruned) != len(origin) {
+			t.Errorf("%v: pruned history has %d blocks, origin %d", addr, len(pruned), len(origin))
+		}
+		for n, want := range origin {
+			got, ok := pruned[n]
+			if !ok || got.Balance != want.Balance || got.Nonce != want.Nonce {
+				t.Errorf("%v at block %d: pruned %+v, origin %+v", addr, n, got, want)
+			}
+		}
+	}
+}
+
+func TestPrunedHistoryRefreshesReorgedWindow(t *testing.T) {
+	c := newTestChain(t, busyTransfers(10))
+	if err := prune(c.src, fixedSchedule(5), 6, 10); err != nil {
+		t.Fatal(err)
+	}
+	// Replace blocks 8 to 10 by empty ones
+	fork := c.extend(t, c.blocks[6], make([][]transfer, 3))
+
+	rows := 0
+	err := prunedHistory(c.src, fixedSchedule(5), c.addrs[0], 6, 10, func(row historyRow) error {
+		rows++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := loadManifest()
+	if m.Windows[10].Checkpoint.Hash != fork[2].Hash() {
+		t.Errorf("history left window 10 at %x, want the fork's %x", m.Windows[10].Checkpoint.Hash, fork[2].Hash())
+	}
+	// Blocks 6 and 7 each send twice and receive once, the fork blocks are empty
+	if rows != 6 {
+		t.Errorf("%d history rows, want 6", rows)
+	}
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// impactReport receives one row per window and one for the run when prune runs
+// dry: the windows are pruned in memory and measured, but no deleted-account
+// file, manifest or flat state is written. Nil runs prune for real.
+var impactReport *csv.Writer
+
+// windowImpact is what pruning a window would do. The replay costs are in the
+// units of the planner, summed over and the highest of the pruned blocks.
+type windowImpact struct {
+	Checkpoint    uint64
+	Low           uint64
+	Blocks        int
+	Pruned        int
+	Accounts      int
+	Deleted       int
+	FreedBytes    int
+	ReplayCost    uint64
+	MaxReplayCost uint64
+}
+
+func (w *windowImpact) add(o windowImpact) {
+	w.Blocks += o.Blocks
+	w.Pruned += o.Pruned
+	w.Accounts += o.Accounts
+	w.Deleted += o.Deleted
+	w.FreedBytes += o.FreedBytes
+	w.ReplayCost += o.ReplayCost
+	if o.MaxReplayCost > w.MaxReplayCost {
+		w.MaxReplayCost = o.MaxReplayCost
+	}
+}
+
+// estimateImpact measures a window pruned in memory and estimates what a query
+// of each of its pruned blocks would replay once the states are gone.
+func estimateImpact(p *planner, entry *windowEntry) (windowImpact, error) {
+	impact := windowImpact{
+		Checkpoint: entry.Checkpoint.Number,
+		Low:        entry.low(),
+		Blocks:     len(entry.Blocks) + 1,
+		Pruned:     len(entry.Blocks),
+		Accounts:   entry.Accounts,
+		Deleted:    entry.Deleted,
+		FreedBytes: entry.Space.freedBytes(),
+	}
+	for _, blk := range entry.Blocks {
+		cost, err := p.replayEstimate(blk.Number)
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return impact, err
+			}
+			continue
+		}
+		impact.ReplayCost += cost
+		if cost > impact.MaxReplayCost {
+			impact.MaxReplayCost = cost
+		}
+	}
+	return impact, nil
+}
+
+// scheduleLabel names a schedule in the report, the interval of a fixed one or
+// metric:budget of an adaptive one, so reports of several runs can be joined.
+func scheduleLabel(sched schedule) string {
+	switch s := sched.(type) {
+	case fixedSchedule:
+		return strconv.Itoa(int(s))
+	case *adaptiveSchedule:
+		return fmt.Sprintf("%s:%d", s.Metric, s.Budget)
+	}
+	return "?"
+}
+
+// openImpactReport starts the dry-run report on w and writes its header.
+func openImpactReport(w io.Writer) {
+	impactReport = csv.NewWriter(w)
+	impactReport.Write([]string{"schedule", "scope", "checkpoint", "low", "blocks", "pruned", "num_of_account", "deleted",
+		"freed_bytes", "replay_cost", "avg_replay_cost", "max_replay_cost"})
+	impactReport.Flush()
+}
+
+// reportImpact writes one row of the report. Scope is window or total.
+func reportImpact(sched schedule, scope string, w windowImpact) {
+	if impactReport == nil {
+		return
+	}
+	var avg uint64
+	if w.Pruned > 0 {
+		avg = w.ReplayCost / uint64(w.Pruned)
+	}
+	itoa, utoa := strconv.Itoa, func(n uint64) string { return strconv.FormatUint(n, 10) }
+	impactReport.Write([]string{scheduleLabel(sched), scope, utoa(w.Checkpoint), utoa(w.Low), itoa(w.Blocks), itoa(w.Pruned),
+		itoa(w.Accounts), itoa(w.Deleted), itoa(w.FreedBytes), utoa(w.ReplayCost), utoa(avg), utoa(w.MaxReplayCost)})
+	impactReport.Flush()
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// DoInspect scans a block range before a long prune or query run and reports
+// which states are still resolvable, where the freezer boundary is and how
+// much work the run would be. "inspect deleted" reads the deleted-account
+// files instead.
+func DoInspect(cmdline []string) {
+	if len(cmdline) > 0 && cmdline[0] == "deleted" {
+		doInspectDeleted(cmdline[1:])
+		return
+	}
+	fs := newFlagSet("inspect")
+	inter := fs.Int("interval", 0, "checkpoint interval used to estimate the prune and query work")
+	full := fs.Bool("full", false, "walk every node of each state trie instead of checking the root only")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 2 {
+		fmt.Println("Error! Must indicate begin blknum and end blknum.")
+		return
+	}
+
+	// Inspecting never writes, so it can run next to a live geth
+	readOnly = true
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[0], cmdline[1])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	if err := inspectRange(src, upNum, endNum, *inter, *full); err != nil {
+		fmt.Println("Error!", err)
+	}
+}
+
+// stateRun is a run of consecutive blocks whose states are all available or
+// all missing.
+type stateRun struct {
+	From, To  int
+	Available bool
+}
+
+// rangeScan is what inspect found in a block range.
+type rangeScan struct {
+	Blocks, Txs                  int
+	MissingBlocks, MissingStates int
+	Runs                         []stateRun
+}
+
+// scanRange checks the block and state of every block in [upNum, endNum].
+func scanRange(src *ChainSource, upNum int, endNum int, full bool) rangeScan {
+	scan := rangeScan{Blocks: endNum - upNum + 1}
+	if scan.Blocks < 0 {
+		scan.Blocks = 0
+	}
+	for i := upNum; i <= endNum; i++ {
+		err := checkState(src, uint64(i), full)
+		if errors.Is(err, ErrBlockMissing) {
+			fmt.Println(err)
+			scan.MissingBlocks++
+		} else if err != nil {
+			scan.MissingStates++
+		}
+		ok := err == nil
+		if blkBody, err := readBody(src.DB, uint64(i)); err == nil {
+			scan.Txs += len(blkBody.Transactions)
+		}
+		if n := len(scan.Runs); n > 0 && scan.Runs[n-1].Available == ok {
+			scan.Runs[n-1].To = i
+		} else {
+			scan.Runs = append(scan.Runs, stateRun{From: i, To: i, Available: ok})
+		}
+	}
+	return scan
+}
+
+func inspectRange(src *ChainSource, upNum int, endNum int, inter int, full bool) error {
+	src.printHead()
+	// Blocks below the freezer boundary are served from the ancient store
+	if frozen, err := src.DB.Ancients(); err == nil {
+		fmt.Printf("Ancient boundary: blocks below %d are frozen.\n", frozen)
+	} else {
+		fmt.Printf("Ancient boundary: no freezer (%v).\n", err)
+	}
+
+	fmt.Println("----------------------------------------------------------------")
+	scan := scanRange(src, upNum, endNum, full)
+	for _, run := range scan.Runs {
+		if run.Available {
+			fmt.Printf("State available: [%d, %d]\n", run.From, run.To)
+		} else {
+			fmt.Printf("State MISSING  : [%d, %d]\n", run.From, run.To)
+		}
+	}
+
+	blocks, txs := scan.Blocks, scan.Txs
+	fmt.Println("----------------------------------------------------------------")
+	fmt.Printf("Blocks: %d, missing blocks: %d, missing states: %d, transactions: %d.\n", blocks, scan.MissingBlocks, scan.MissingStates, txs)
+	fmt.Printf("Prune estimate: %d trie opens, %d sender recoveries.\n", blocks, txs)
+	if inter > 0 && blocks > 0 {
+		// A point query of every block replays on average half a window
+		windows := blocks/inter + 1
+		replay := windows * inter * (inter - 1) / 2
+		fmt.Printf("Query estimate: %d checkpoints, %d origin trie opens, %d replayed blocks (~%d txs).\n",
+			windows, blocks, replay, replay*txs/blocks)
+	}
+	return nil
+}
+
+// checkState returns nil if the state of block number can be resolved. Without
+// full only the root node is looked up, otherwise the whole account trie is
+// walked. Missing blocks and states are reported as typed errors.
+func checkState(src *ChainSource, number uint64, full bool) error {
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return err
+	}
+	if blkHeader.Root == types.EmptyRootHash {
+		return nil
+	}
+	if !full {
+		if _, err := src.TrieDB.Node(blkHeader.Root); err != nil {
+			return &StateMissingError{Number: number, Root: blkHeader.Root, Err: err}
+		}
+		return nil
+	}
+	Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, src.TrieDB)
+	if err != nil {
+		return wrapTrieErr(err, number, blkHeader.Root)
+	}
+	it := Trie.NodeIterator(nil)
+	for it.Next(true) {
+	}
+	return wrapTrieErr(it.Error(), number, blkHeader.Root)
+}
+
+// preflight checks that the state of every step-th block in [upNum, endNum] is
+// there before a long run starts. Under the stop policy a gap aborts the run.
+func preflight(src *ChainSource, upNum int, endNum int, step int) error {
+	for i := upNum; i <= endNum; i += step {
+		if err := preflightState(src, uint64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preflightCheckpoints checks the checkpoints a pruned query of [upNum, endNum]
+// starts from.
+func preflightCheckpoints(src *ChainSource, sched schedule, upNum int, endNum int) error {
+	for _, cp := range queryCheckpoints(sched, uint64(upNum), uint64(endNum)) {
+		if err := preflightState(src, cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func preflightState(src *ChainSource, number uint64) error {
+	if err := checkState(src, number, false); err != nil {
+		if onMissing == policyStop {
+			return fmt.Errorf("preflight: %w, run inspect to see which states are available", err)
+		}
+		fmt.Printf("Preflight: %v\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestScanRange(t *testing.T) {
+	c := newTestChain(t, busyTransfers(12))
+	c.dropState(5)
+	c.dropState(6)
+	c.dropBody(9)
+
+	scan := scanRange(c.src, 3, 10, false)
+	want := []stateRun{{3, 4, true}, {5, 6, false}, {7, 10, true}}
+	if !reflect.DeepEqual(scan.Runs, want) {
+		t.Errorf("runs %v, want %v", scan.Runs, want)
+	}
+	// Block 9 keeps its header and state, only its transactions can't be counted
+	if scan.Blocks != 8 || scan.MissingStates != 2 || scan.MissingBlocks != 0 || scan.Txs != 7*5 {
+		t.Errorf("scan %+v", scan)
+	}
+
+	c.dropHeader(4)
+	if scan = scanRange(c.src, 3, 10, true); scan.MissingBlocks != 1 || scan.MissingStates != 2 {
+		t.Errorf("full scan with block 4 missing: %+v", scan)
+	}
+
+	// An empty range scans nothing and estimates nothing
+	if scan = scanRange(c.src, 11, 10, false); scan.Blocks != 0 || len(scan.Runs) != 0 {
+		t.Errorf("empty range: %+v", scan)
+	}
+	if err := inspectRange(c.src, 11, 10, 5, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	c := newTestChain(t, busyTransfers(12))
+	c.dropState(6)
+	defer func() { onMissing = policyStop }()
+
+	if err := preflight(c.src, 1, 12, 1); !errors.Is(err, ErrStateMissing) {
+		t.Errorf("stop: preflight over a missing state gives %v", err)
+	}
+	// Stepping over the gap doesn't see it
+	if err := preflight(c.src, 1, 12, 4); err != nil {
+		t.Errorf("stop: preflight of blocks 1, 5 and 9 gives %v", err)
+	}
+	if err := preflightCheckpoints(c.src, fixedSchedule(3), 7, 12); !errors.Is(err, ErrStateMissing) {
+		t.Errorf("stop: preflight of checkpoints 6, 9 and 12 gives %v", err)
+	}
+	if err := preflightCheckpoints(c.src, fixedSchedule(4), 7, 12); err != nil {
+		t.Errorf("stop: preflight of checkpoints 4, 8 and 12 gives %v", err)
+	}
+
+	onMissing = policySkip
+	if err := preflight(c.src, 1, 12, 1); err != nil {
+		t.Errorf("skip: preflight gives %v", err)
+	}
+}
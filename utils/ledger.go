@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+)
+
+// ledger is the balance and nonce of an account during replay. It is a plain
+// value: every operation returns a new ledger and never touches the big.Ints
+// it was built from or handed out, so a ledger loaded from a cached trie
+// account can be replayed any number of times with the same result.
+type ledger struct {
+	balance uint256.Int
+	nonce   uint64
+}
+
+// newLedger copies the balance and nonce of acc.
+func newLedger(acc *types.StateAccount) (ledger, error) {
+	var l ledger
+	if acc.Balance != nil && l.balance.SetFromBig(acc.Balance) {
+		return l, fmt.Errorf("balance %v overflows 256 bits", acc.Balance)
+	}
+	l.nonce = acc.Nonce
+	return l, nil
+}
+
+// Balance returns a fresh copy of the balance.
+func (l ledger) Balance() *big.Int { return l.balance.ToBig() }
+
+// Nonce returns the nonce.
+func (l ledger) Nonce() uint64 { return l.nonce }
+
+// credit returns the ledger with amount added to the balance.
+func (l ledger) credit(amount *big.Int) (ledger, error) {
+	v, overflow := uint256.FromBig(amount)
+	if overflow || amount.Sign() < 0 {
+		return l, fmt.Errorf("credit of %v out of range", amount)
+	}
+	out := l
+	if _, overflow := out.balance.AddOverflow(&l.balance, v); overflow {
+		return l, fmt.Errorf("balance overflows 256 bits after credit of %v", amount)
+	}
+	return out, nil
+}
+
+// debit returns the ledger with amount taken from the balance. A balance
+// going below zero means replay missed a credit, so it is an ErrMissedCredit
+// rather than a wrapped value.
+func (l ledger) debit(amount *big.Int) (ledger, error) {
+	v, overflow := uint256.FromBig(amount)
+	if overflow || amount.Sign() < 0 {
+		return l, fmt.Errorf("debit of %v out of range", amount)
+	}
+	out := l
+	if _, underflow := out.balance.SubOverflow(&l.balance, v); underflow {
+		return l, fmt.Errorf("%w: balance %v can't cover debit of %v", ErrMissedCredit, l.Balance(), amount)
+	}
+	return out, nil
+}
+
+// apply returns the ledger with the signed delta added to the balance.
+func (l ledger) apply(delta *big.Int) (ledger, error) {
+	if delta.Sign() < 0 {
+		return l.debit(new(big.Int).Neg(delta))
+	}
+	return l.credit(delta)
+}
+
+// send returns the ledger after the account sent a transaction.
+func (l ledger) send() ledger {
+	l.nonce++
+	return l
+}
+
+// unsend returns the ledger before the account sent a transaction.
+func (l ledger) unsend() (ledger, error) {
+	if l.nonce == 0 {
+		return l, fmt.Errorf("nonce 0 can't take back a sent transaction")
+	}
+	l.nonce--
+	return l, nil
+}
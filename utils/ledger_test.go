@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Any sequence of credits and debits lands where big.Int arithmetic does and
+// leaves the ledgers and amounts it was given untouched.
+func TestLedgerMatchesBigInt(t *testing.T) {
+	property := func(start uint64, amounts []int64) bool {
+		acc := &types.StateAccount{Balance: new(big.Int).SetUint64(start)}
+		l, err := newLedger(acc)
+		if err != nil {
+			return false
+		}
+		want := new(big.Int).SetUint64(start)
+		for _, a := range amounts {
+			before, amount := l, big.NewInt(a)
+			next, err := l.apply(amount)
+			if l != before || amount.Int64() != a {
+				return false
+			}
+			if want.Add(want, amount); want.Sign() < 0 {
+				// Replay never lets a balance go negative
+				if err == nil {
+					return false
+				}
+				want.Sub(want, amount)
+				continue
+			}
+			if err != nil {
+				return false
+			}
+			l = next
+		}
+		return l.Balance().Cmp(want) == 0 && acc.Balance.Uint64() == start
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLedgerBalanceIsACopy(t *testing.T) {
+	l, err := newLedger(&types.StateAccount{Balance: big.NewInt(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Balance().SetInt64(1)
+	if l.Balance().Int64() != 100 {
+		t.Fatalf("mutating a returned balance changed the ledger to %v", l.Balance())
+	}
+}
+
+// Replaying the same block from the same checkpoint gives the same answer no
+// matter which queries ran before, even though the checkpoint tries are cached.
+func TestReplayIndependentOfQueryOrder(t *testing.T) {
+	const inter = 5
+	c := newTestChain(t, busyTransfers(20))
+	addrs := append([]common.Address{c.miner}, c.addrs...)
+
+	type query struct {
+		addr  common.Address
+		block uint64
+	}
+	answer := func(q query) ledger {
+		_, acc, err := checkpointAccount(c.src, q.addr, q.block-q.block%inter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := newLedger(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := q.block - q.block%inter + 1; k <= q.block; k++ {
+			if l, err = replayBlock(c.src.DB, k, q.addr, l, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return l
+	}
+	var queries []query
+	for _, addr := range addrs {
+		for n := uint64(5); n <= 20; n++ {
+			queries = append(queries, query{addr, n})
+		}
+	}
+	want := map[query]ledger{}
+	for _, q := range queries {
+		want[q] = answer(q)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 3; round++ {
+		rnd.Shuffle(len(queries), func(i, j int) { queries[i], queries[j] = queries[j], queries[i] })
+		for _, q := range queries {
+			if got := answer(q); got != want[q] {
+				t.Fatalf("round %d, %v at block %d: got balance %v nonce %d, want %v nonce %d",
+					round, q.addr, q.block, got.Balance(), got.Nonce(), want[q].Balance(), want[q].Nonce())
+			}
+		}
+	}
+}
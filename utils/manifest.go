@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// blockRef pins a block number to the canonical hash it had when it was processed.
+type blockRef struct {
+	Number uint64      `json:"number"`
+	Hash   common.Hash `json:"hash"`
+}
+
+// windowEntry describes one pruning window: the checkpoint block on top and
+// every block written to its deleted-account file, in file (descending) order.
+type windowEntry struct {
+	Checkpoint blockRef   `json:"checkpoint"`
+	Blocks     []blockRef `json:"blocks"`
+	File       string     `json:"file"`
+	Deleted    int        `json:"deleted"`
+	Accounts   int        `json:"accounts"` // num_of_account, unique senders and recipients
+	Space      spaceUsage `json:"space"`
+
+	Rehydrated []rehydration `json:"rehydrated,omitempty"`
+}
+
+// manifest records what DoPrune produced so that queries can tell whether the
+// deleted-account files still describe the canonical chain.
+type manifest struct {
+	Interval int                     `json:"interval"`
+	Schedule *adaptiveSchedule       `json:"schedule,omitempty"` // set instead of Interval by adaptive pruning
+	Windows  map[uint64]*windowEntry `json:"windows"`
+}
+
+// loadManifest reads the manifest from the deleted-account directory. A missing
+// manifest is not an error, it simply means nothing was pruned yet.
+func loadManifest() (*manifest, error) {
+	m := &manifest{Windows: map[uint64]*windowEntry{}}
+	data, err := os.ReadFile(manifestPath())
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("corrupted manifest %s: %v", manifestPath(), err)
+	}
+	if m.Windows == nil {
+		m.Windows = map[uint64]*windowEntry{}
+	}
+	return m, nil
+}
+
+// checkpoints returns the schedule the windows were pruned with, nil if
+// nothing was pruned yet.
+func (m *manifest) checkpoints() schedule {
+	if m.Schedule != nil {
+		return m.Schedule
+	}
+	if m.Interval > 0 {
+		return fixedSchedule(m.Interval)
+	}
+	return nil
+}
+
+// prunedWindow returns the checkpoint of the window in which block number was
+// pruned, if any. Checkpoints themselves keep their state.
+func (m *manifest) prunedWindow(number uint64) (uint64, bool) {
+	for cp, w := range m.Windows {
+		if number >= w.low() && number < cp {
+			return cp, true
+		}
+	}
+	return 0, false
+}
+
+// save writes the manifest back next to the deleted-account files.
+func (m *manifest) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath(), data, 0666)
+}
+
+// low returns the lowest block number covered by the window.
+func (w *windowEntry) low() uint64 {
+	if len(w.Blocks) == 0 {
+		return w.Checkpoint.Number
+	}
+	return w.Blocks[len(w.Blocks)-1].Number
+}
+
+// canonical reports whether every block of the window, checkpoint included,
+// still carries the hash recorded when the window was pruned.
+func (w *windowEntry) canonical(db ethdb.Reader) bool {
+	if rawdb.ReadCanonicalHash(db, w.Checkpoint.Number) != w.Checkpoint.Hash {
+		return false
+	}
+	for _, blk := range w.Blocks {
+		if rawdb.ReadCanonicalHash(db, blk.Number) != blk.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// staleWindows returns the checkpoints of all windows overlapping [upNum, endNum]
+// whose recorded hashes no longer match the canonical chain, in ascending order.
+func (m *manifest) staleWindows(db ethdb.Reader, upNum uint64, endNum uint64) []uint64 {
+	var stale []uint64
+	for cp, w := range m.Windows {
+		if cp < upNum || w.low() > endNum {
+			continue
+		}
+		if !w.canonical(db) {
+			stale = append(stale, cp)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i] < stale[j] })
+	return stale
+}
+
+// refreshWindows re-prunes every window overlapping [upNum, endNum] that no
+// longer matches the canonical chain, so queries never rely on stale files.
+func refreshWindows(src *ChainSource, upNum int, endNum int) error {
+	m, err := loadManifest()
+	if err != nil {
+		return err
+	}
+	stale := m.staleWindows(src.DB, uint64(upNum), uint64(endNum))
+	if len(stale) == 0 {
+		return nil
+	}
+	for _, cp := range stale {
+		fmt.Printf("Window %v is not canonical anymore, regenerating.\n", cp)
+		entry, err := pruneWindow(src, int(cp), int(m.Windows[cp].low()))
+		if err != nil {
+			return err
+		}
+		m.Windows[cp] = entry
+	}
+	return m.save()
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Costs of reading a state, in the units of the cost metric of adaptive
+// checkpoints: replaying a block is one unit plus one per transaction.
+const (
+	// snapshotReadCost is a single key lookup in a snapshot layer or flat copy
+	snapshotReadCost = 1
+	// trieReadCost is a walk from a state root down to the account, several
+	// node reads most of which miss the cache
+	trieReadCost = 20
+)
+
+// Paths a planned query can take to the state of an account.
+const (
+	pathSnapshot = "snapshot" // the flat state of the block
+	pathOrigin   = "origin"   // the original trie of the block
+	pathForward  = "forward"  // the checkpoint at or below the block plus forward replay
+	pathBackward = "backward" // the next checkpoint plus backward replay
+)
+
+// queryPath is one way to a state: the block whose state it reads and the
+// estimated cost, or why it can't be taken.
+type queryPath struct {
+	Path    string
+	From    uint64
+	Cost    uint64
+	Blocked string // empty if the path is available
+}
+
+// queryPlan lists the paths to the state of block Number, the available ones
+// first from the cheapest.
+type queryPlan struct {
+	Number uint64
+	Paths  []queryPath
+}
+
+func (p *queryPlan) print() {
+	fmt.Printf("Plan for block %d:\n", p.Number)
+	for i, path := range p.Paths {
+		switch {
+		case path.Blocked != "":
+			fmt.Printf("     %-8s from %d: %s\n", path.Path, path.From, path.Blocked)
+		case i == 0:
+			fmt.Printf("  -> %-8s from %d, cost %d\n", path.Path, path.From, path.Cost)
+		default:
+			fmt.Printf("     %-8s from %d, cost %d\n", path.Path, path.From, path.Cost)
+		}
+	}
+}
+
+// planner estimates the cost of every path to the state of an account at a
+// block and takes the cheapest. Replay is estimated from the headers alone,
+// the gas used bounding the number of transactions to recover senders of.
+type planner struct {
+	src   *ChainSource
+	sched schedule
+	m     *manifest
+	txs   map[uint64]uint64 // estimated transactions by block
+}
+
+func newPlanner(src *ChainSource, sched schedule) (*planner, error) {
+	m, err := loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	return &planner{src: src, sched: sched, m: m, txs: map[uint64]uint64{}}, nil
+}
+
+// replayCost estimates the replay of the blocks in (from, to].
+func (p *planner) replayCost(from uint64, to uint64) (uint64, error) {
+	var cost uint64
+	for k := from + 1; k <= to; k++ {
+		txs, ok := p.txs[k]
+		if !ok {
+			_, blkHeader, err := readHeader(p.src.DB, k)
+			if err != nil {
+				return 0, err
+			}
+			txs = blkHeader.GasUsed / params.TxGas
+			p.txs[k] = txs
+		}
+		cost += 1 + txs
+	}
+	return cost, nil
+}
+
+// replayEstimate returns the cost of the cheaper replay path to the state of
+// block number once it is pruned, whether or not its state is there now.
+func (p *planner) replayEstimate(number uint64) (uint64, error) {
+	cp := p.sched.below(number)
+	cost, err := p.replayCost(cp, number)
+	if err != nil {
+		return 0, err
+	}
+	if cp, ok := p.sched.above(number); ok && backwardReplay {
+		backward, err := p.replayCost(number, cp)
+		if err == nil && backward < cost {
+			cost = backward
+		}
+	}
+	return trieReadCost + cost, nil
+}
+
+// plan lists the paths to the state of block number.
+func (p *planner) plan(number uint64) (*queryPlan, error) {
+	_, blkHeader, err := readHeader(p.src.DB, number)
+	if err != nil {
+		return nil, err
+	}
+	plan := &queryPlan{Number: number}
+
+	snap := queryPath{Path: pathSnapshot, From: number, Cost: snapshotReadCost}
+	if p.src.snaps == nil || !p.src.snaps.covers(blkHeader.Root) {
+		snap.Blocked = "no snapshot holds the state"
+	}
+	plan.Paths = append(plan.Paths, snap)
+
+	origin := queryPath{Path: pathOrigin, From: number, Cost: trieReadCost}
+	if cp, ok := p.m.prunedWindow(number); ok {
+		origin.Blocked = fmt.Sprintf("pruned in window %d", cp)
+	} else if err := checkState(p.src, number, false); err != nil {
+		origin.Blocked = err.Error()
+	}
+	plan.Paths = append(plan.Paths, origin)
+
+	if cp := p.sched.below(number); cp < number {
+		forward := queryPath{Path: pathForward, From: cp, Cost: trieReadCost}
+		cost, err := p.replayCost(cp, number)
+		forward.Cost += cost
+		if err == nil {
+			err = checkState(p.src, cp, false)
+		}
+		if err != nil {
+			forward.Blocked = err.Error()
+		}
+		plan.Paths = append(plan.Paths, forward)
+	}
+
+	if cp, ok := p.sched.above(number); ok {
+		backward := queryPath{Path: pathBackward, From: cp, Cost: trieReadCost}
+		cost, err := p.replayCost(number, cp)
+		backward.Cost += cost
+		if err == nil {
+			err = checkState(p.src, cp, false)
+		}
+		if err != nil {
+			backward.Blocked = err.Error()
+		} else if !backwardReplay {
+			backward.Blocked = "backward replay disabled"
+		}
+		plan.Paths = append(plan.Paths, backward)
+	}
+
+	sort.SliceStable(plan.Paths, func(i, j int) bool {
+		a, b := plan.Paths[i], plan.Paths[j]
+		if (a.Blocked == "") != (b.Blocked == "") {
+			return a.Blocked == ""
+		}
+		return a.Cost < b.Cost
+	})
+	return plan, nil
+}
+
+// answer takes the cheapest path of plan that gets to the state of account and
+// returns it with the path taken. A snapshot that can't serve the read, e.g.
+// a layer still being generated, hands over to the next path.
+func (p *planner) answer(plan *queryPlan, account common.Address) (BlockState, string, error) {
+	for _, path := range plan.Paths {
+		if path.Blocked != "" {
+			break
+		}
+		switch path.Path {
+		case pathSnapshot:
+			_, blkHeader, err := readHeader(p.src.DB, plan.Number)
+			if err != nil {
+				return BlockState{}, "", err
+			}
+			acc, ok := p.src.snaps.read(blkHeader.Root, account)
+			if !ok {
+				continue
+			}
+			if acc == nil {
+				acc = emptyAccount()
+			}
+			return BlockState{Number: plan.Number, Balance: acc.Balance, Nonce: acc.Nonce}, path.Path, nil
+		case pathOrigin:
+			_, Trie, err := openState(p.src, plan.Number)
+			if err != nil {
+				return BlockState{}, "", err
+			}
+			acc, err := readAccount(p.src, Trie, account, plan.Number)
+			if errors.Is(err, ErrAccountAbsent) {
+				acc, err = emptyAccount(), nil
+			}
+			if err != nil {
+				return BlockState{}, "", err
+			}
+			return BlockState{Number: plan.Number, Balance: acc.Balance, Nonce: acc.Nonce}, path.Path, nil
+		case pathForward:
+			base, now, err := checkpointLedger(p.src, account, path.From)
+			if err != nil {
+				return BlockState{}, "", err
+			}
+			for k := base + 1; k <= plan.Number; k++ {
+				if now, err = replayBlock(p.src.DB, k, account, now, nil); err != nil {
+					return BlockState{}, "", err
+				}
+			}
+			return BlockState{Number: plan.Number, Balance: now.Balance(), Nonce: now.Nonce()}, path.Path, nil
+		case pathBackward:
+			cp, now, err := checkpointLedger(p.src, account, path.From)
+			if err == nil && cp != path.From {
+				// A fallback state of an earlier block can't be reverted from
+				continue
+			}
+			if err != nil {
+				return BlockState{}, "", err
+			}
+			for k := cp; k > plan.Number; k-- {
+				if now, err = revertBlock(p.src.DB, k, account, now); err != nil {
+					return BlockState{}, "", err
+				}
+			}
+			return BlockState{Number: plan.Number, Balance: now.Balance(), Nonce: now.Nonce()}, path.Path, nil
+		}
+	}
+	return BlockState{}, "", fmt.Errorf("no available path to the state of block %d", plan.Number)
+}
+
+// plannedPointQuery answers the same blocks as prunedPointQuery, each by the
+// path the planner estimates cheapest. With explain every plan is printed.
+func plannedPointQuery(src *ChainSource, sched schedule, account string, upNum int, endNum int, explain bool) (map[uint64]*types.StateAccount, error) {
+	p, err := newPlanner(src, sched)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("----------------------Planned Point Query----------------------")
+	accounts := map[uint64]*types.StateAccount{}
+	taken := map[string]int{}
+	stats := newQueryStats()
+	for j := upNum; j <= endNum; j++ {
+		roundTime := time.Now()
+		plan, err := p.plan(uint64(j))
+		if err == nil && explain {
+			plan.print()
+		}
+		var (
+			s    BlockState
+			path string
+		)
+		if err == nil {
+			s, path, err = p.answer(plan, common.HexToAddress(account))
+		}
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		taken[path]++
+		accounts[uint64(j)] = &types.StateAccount{Balance: s.Balance, Nonce: s.Nonce}
+		stats.record(time.Since(roundTime))
+	}
+
+	src.finishQuery(timingPlannedPoint, stats)
+	fmt.Printf("Paths taken: %d snapshot, %d origin, %d forward, %d backward.\n",
+		taken[pathSnapshot], taken[pathOrigin], taken[pathForward], taken[pathBackward])
+	src.cache.printStats()
+	return accounts, nil
+}
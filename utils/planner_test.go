@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestPlannerPaths(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPlanner(c.src, fixedSchedule(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Block 13 was pruned, backward replay of 2 blocks of 5 transfers beats forward replay of 3
+	plan, err := p.plan(13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]queryPath{}
+	for _, path := range plan.Paths {
+		paths[path.Path] = path
+	}
+	if best := plan.Paths[0]; best.Path != pathBackward || best.From != 15 || best.Cost != trieReadCost+2*6 {
+		t.Errorf("block 13: best path %+v", best)
+	}
+	if fwd := paths[pathForward]; fwd.Blocked != "" || fwd.From != 10 || fwd.Cost != trieReadCost+3*6 {
+		t.Errorf("block 13: forward path %+v", fwd)
+	}
+	if paths[pathOrigin].Blocked == "" || paths[pathSnapshot].Blocked == "" {
+		t.Errorf("block 13: origin %+v and snapshot %+v available", paths[pathOrigin], paths[pathSnapshot])
+	}
+
+	// A checkpoint keeps its own trie
+	if plan, err = p.plan(15); err != nil {
+		t.Fatal(err)
+	}
+	if best := plan.Paths[0]; best.Path != pathOrigin || best.Cost != trieReadCost {
+		t.Errorf("block 15: best path %+v", best)
+	}
+}
+
+func TestPlannedPointQueryMatchesOrigin(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	src := snapshotSource(t, c)
+	if err := prune(src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range append(c.addrs, c.miner) {
+		origin, err := originPointQuery(c.src, addr.Hex(), 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		planned, err := plannedPointQuery(src, fixedSchedule(5), addr.Hex(), 1, 20, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, want := range origin {
+			got := planned[n]
+			if got == nil || got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce {
+				t.Errorf("%v block %d: planned %+v, origin %+v", addr, n, got, want)
+			}
+		}
+	}
+	// The flattened checkpoints are read as snapshots
+	if src.snaps.Stats.Flat == 0 {
+		t.Errorf("planned reads: %v, want some from flat checkpoints", src.snaps.Stats)
+	}
+}
+
+func TestPlannedPointQueryEmptyRange(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := plannedPointQuery(c.src, fixedSchedule(5), c.addrs[0].Hex(), 11, 10, false)
+	if err != nil || len(accounts) != 0 {
+		t.Errorf("empty range gives %v, %v", accounts, err)
+	}
+	if stats := c.src.timings[timingPlannedPoint]; stats == nil || stats.Rounds != 0 {
+		t.Errorf("empty range timings %+v", stats)
+	}
+}
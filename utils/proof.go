@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// proofList collects the nodes of a Merkle proof from the root down, like
+// the accountProof of eth_getProof.
+type proofList []hexutil.Bytes
+
+func (p *proofList) Put(key []byte, value []byte) error {
+	*p = append(*p, common.CopyBytes(value))
+	return nil
+}
+
+func (p *proofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+// AccountProof is the eth_getProof style proof of an account in the state of
+// a block. An absent account is proven by the path ending without it.
+type AccountProof struct {
+	Address      common.Address `json:"address"`
+	AccountProof proofList      `json:"accountProof"`
+	Balance      *hexutil.Big   `json:"balance"`
+	Nonce        hexutil.Uint64 `json:"nonce"`
+	CodeHash     common.Hash    `json:"codeHash"`
+	StorageHash  common.Hash    `json:"storageHash"`
+}
+
+// ReplayedBlock is what replay used from one block: its header, the uncles
+// the miner rewards depend on, and every transaction in the binary encoding,
+// so a verifier can rebuild the tx root and no transfer can be left out.
+type ReplayedBlock struct {
+	Header       *types.Header   `json:"header"`
+	Uncles       []*types.Header `json:"uncles,omitempty"`
+	Transactions []hexutil.Bytes `json:"transactions"`
+}
+
+// StateProof makes an answer of the pruned query engine checkable: the
+// account proof at the checkpoint, then every block replayed up to Block with
+// all its transactions. Balance and Nonce are the answer
+// the replay reached.
+type StateProof struct {
+	Address    common.Address  `json:"address"`
+	Block      hexutil.Uint64  `json:"block"`
+	Checkpoint *types.Header   `json:"checkpoint"`
+	Account    AccountProof    `json:"account"`
+	Replayed   []ReplayedBlock `json:"replayed"`
+	Balance    *hexutil.Big    `json:"balance"`
+	Nonce      hexutil.Uint64  `json:"nonce"`
+}
+
+// proveAccount proves the account of addr in the original state trie of
+// block number.
+func proveAccount(src *ChainSource, addr common.Address, number uint64) (*types.Header, AccountProof, error) {
+	proof := AccountProof{Address: addr}
+	blkHeader, Trie, err := openState(src, number)
+	if err != nil {
+		return nil, proof, err
+	}
+	// Prove takes the hashed key, TryGetAccount hashes it itself
+	if err := Trie.Prove(crypto.Keccak256(addr.Bytes()), 0, &proof.AccountProof); err != nil {
+		return nil, proof, wrapTrieErr(err, number, blkHeader.Root)
+	}
+	acc, err := readAccount(src, Trie, addr, number)
+	if errors.Is(err, ErrAccountAbsent) {
+		acc, err = emptyAccount(), nil
+	}
+	if err != nil {
+		return nil, proof, err
+	}
+	proof.Balance = (*hexutil.Big)(acc.Balance)
+	proof.Nonce = hexutil.Uint64(acc.Nonce)
+	proof.CodeHash = common.BytesToHash(acc.CodeHash)
+	proof.StorageHash = acc.Root
+	return blkHeader, proof, nil
+}
+
+// proveState answers the balance and nonce of account at block number like the
+// pruned engine, from the checkpoint at or below number, and proves the answer.
+func proveState(src *ChainSource, sched schedule, account common.Address, number uint64) (*StateProof, error) {
+	cp := sched.below(number)
+	checkpoint, accProof, err := proveAccount(src, account, cp)
+	if err != nil {
+		return nil, err
+	}
+	p := &StateProof{Address: account, Block: hexutil.Uint64(number), Checkpoint: checkpoint, Account: accProof}
+	now, err := newLedger(&types.StateAccount{Balance: accProof.Balance.ToInt(), Nonce: uint64(accProof.Nonce)})
+	if err != nil {
+		return nil, err
+	}
+	for k := cp + 1; k <= number; k++ {
+		_, blkHeader, err := readHeader(src.DB, k)
+		if err != nil {
+			return nil, err
+		}
+		blkBody, err := readBody(src.DB, k)
+		if err != nil {
+			return nil, err
+		}
+		if types.DeriveSha(types.Transactions(blkBody.Transactions), trie.NewStackTrie(nil)) != blkHeader.TxHash {
+			return nil, fmt.Errorf("transactions of block %d don't match its tx root %x", k, blkHeader.TxHash)
+		}
+		txs := make([]hexutil.Bytes, len(blkBody.Transactions))
+		for i, tx := range blkBody.Transactions {
+			if txs[i], err = tx.MarshalBinary(); err != nil {
+				return nil, err
+			}
+		}
+		p.Replayed = append(p.Replayed, ReplayedBlock{Header: blkHeader, Uncles: blkBody.Uncles, Transactions: txs})
+		if now, err = applyBlock(blkHeader, blkBody.Transactions, blkBody.Uncles, account, now, nil); err != nil {
+			return nil, err
+		}
+	}
+	p.Balance = (*hexutil.Big)(now.Balance())
+	p.Nonce = hexutil.Uint64(now.Nonce())
+	return p, nil
+}
+
+// doProve runs "query prove account interval block".
+func doProve(cmdline []string) {
+	fs := newFlagSet("query prove")
+	out := fs.String("out", "", "write the proof to this file instead of stdout")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 3 {
+		fmt.Println("Error! Must indicate the account hash, the block interval (or manifest), and the block number.")
+		return
+	}
+	sched, err := parseSchedule(cmdline[1])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	number, _, err := resolveBlocks(src, cmdline[2], cmdline[2])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	p, err := proveState(src, sched, common.HexToAddress(cmdline[0]), uint64(number))
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p); err != nil {
+		fmt.Println("Error!", err)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+func TestProveState(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	for _, addr := range append([]common.Address{c.miner, {0x01}}, c.addrs...) {
+		p, err := proveState(c.src, fixedSchedule(5), addr, 13)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The answer is the origin state of block 13
+		err = OriginRange(c.src, addr, 13, 13, false, func(s BlockState) error {
+			if s.Balance.Cmp(p.Balance.ToInt()) != 0 || s.Nonce != uint64(p.Nonce) {
+				t.Errorf("%v: proven %v nonce %d, origin %v", addr, p.Balance, p.Nonce, s)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The checkpoint proof resolves against the state root
+		if p.Checkpoint.Number.Uint64() != 10 || p.Checkpoint.Hash() != rawdb.ReadCanonicalHash(c.db, 10) {
+			t.Fatalf("%v: checkpoint is block %v", addr, p.Checkpoint.Number)
+		}
+		val, err := trie.VerifyProof(p.Checkpoint.Root, crypto.Keccak256(addr.Bytes()), proofDB(p.Account.AccountProof))
+		if err != nil {
+			t.Fatalf("%v: account proof: %v", addr, err)
+		}
+		if (val == nil) != (p.Account.Balance.ToInt().Sign() == 0 && p.Account.Nonce == 0) {
+			t.Errorf("%v: account proof gives %x for balance %v", addr, val, p.Account.Balance)
+		}
+
+		// Every replayed block follows the previous one and its transactions are included
+		parent := p.Checkpoint
+		for _, b := range p.Replayed {
+			if b.Header.ParentHash != parent.Hash() {
+				t.Fatalf("%v: block %v doesn't follow %v", addr, b.Header.Number, parent.Number)
+			}
+			parent = b.Header
+			if len(b.Transactions) != 5 {
+				t.Errorf("%v: proof lists %d transactions of block %v, want all 5", addr, len(b.Transactions), b.Header.Number)
+			}
+		}
+		if len(p.Replayed) != 3 || parent.Number.Uint64() != 13 {
+			t.Fatalf("%v: replayed %d blocks up to %v, want 11 to 13", addr, len(p.Replayed), parent.Number)
+		}
+
+		// The proof survives its JSON form
+		enc, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dec StateProof
+		if err := json.Unmarshal(enc, &dec); err != nil {
+			t.Fatal(err)
+		}
+		if dec.Balance.ToInt().Cmp(p.Balance.ToInt()) != 0 || dec.Replayed[2].Header.Hash() != p.Replayed[2].Header.Hash() {
+			t.Errorf("%v: proof changed in JSON", addr)
+		}
+	}
+}
@@ -1,116 +1,300 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
 var (
 	dbPath      = "E:/ethereum/geth/chaindata"
-	ancientPath = dbPath + "/ancient"
+	ancientPath = "" // defaults to dbPath/ancient
 
-	bloomPath = "D:/deleted/Accounts_"
+	deletedDir = "D:/deleted"
 )
 
+// deletedFile returns the path of the deleted-account file of checkpoint cp.
+func deletedFile(cp int) string {
+	return filepath.Join(deletedDir, "Accounts_"+fmt.Sprint(cp)+".txt")
+}
+
+// manifestPath returns the path of the manifest describing the deleted-account files.
+func manifestPath() string {
+	return filepath.Join(deletedDir, "manifest.json")
+}
+
 func DoPrune(cmdline []string) {
+	fs := newFlagSet("prune")
+	report := fs.String("space-report", "", "measure the nodes and bytes freed by pruning into this CSV file")
+	fs.BoolVar(&flattenCheckpoints, "flatten", flattenCheckpoints, "write a flat copy of every checkpoint state for snapshot reads")
+	adaptive := fs.String("adaptive", "", "place checkpoints by a budget of txs, addresses or cost instead of a fixed interval")
+	dryRun := fs.Bool("dry-run", false, "only report what pruning each window would delete, free and cost queries, as CSV")
+	impact := fs.String("impact", "", "write the dry-run report to this CSV file instead of the standard output")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
 	if len(cmdline) < 3 {
+		// With -adaptive the interval argument is the budget of the metric
 		fmt.Println("Error! Must indicate checkpoint block interval, begin blknum, and end blknum.")
 		return
 	}
-	N, err := strconv.Atoi(cmdline[0])
+	src, err := OpenChainSource()
 	if err != nil {
-		panic(err)
+		fmt.Println("Error!", err)
+		return
 	}
-	upNum, err := strconv.Atoi(cmdline[1])
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[1], cmdline[2])
 	if err != nil {
-		panic(err)
+		fmt.Println("Error!", err)
+		return
 	}
-	endNum, err := strconv.Atoi(cmdline[2])
-	if err != nil {
-		panic(err)
+
+	var sched schedule
+	if *adaptive == "" {
+		if sched, err = parseInterval(cmdline[0]); err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+	} else {
+		N, err := strconv.Atoi(cmdline[0])
+		if err != nil || N <= 0 {
+			fmt.Printf("Error! Budget %q is not a positive number.\n", cmdline[0])
+			return
+		}
+		plan, err := planSchedule(src, *adaptive, uint64(N), uint64(upNum), uint64(endNum))
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		fmt.Printf("Adaptive checkpoints: %d for %d blocks with a budget of %d %s.\n", len(plan.Blocks), endNum-upNum+1, N, *adaptive)
+		sched = plan
 	}
 
-	// Open ethereum levelDB with ancient flatten data
-	ancientDb, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, 16, 1, ancientPath, "", false)
-	if err != nil {
-		panic(err)
+	if *report != "" {
+		file, err := openSpaceReport(*report)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		defer func() { spaceReport = nil }()
 	}
+	if *dryRun {
+		// Without a file the report is printed after the progress output
+		var out io.Writer = new(bytes.Buffer)
+		if *impact != "" {
+			file, err := os.Create(*impact)
+			if err != nil {
+				fmt.Println("Error!", err)
+				return
+			}
+			defer file.Close()
+			out = file
+		} else {
+			defer func() { fmt.Print(out) }()
+		}
+		openImpactReport(out)
+		defer func() { impactReport = nil }()
+	}
+	if err := prune(src, sched, upNum, endNum); err != nil {
+		fmt.Println("Error!", err)
+	}
+}
 
-	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
-	currHeader := rawdb.ReadHeadHeaderHash(ancientDb)
-	fmt.Printf("currHeader: %x\n", currHeader)
+// prune keeps the checkpoints sched places in [upNum, endNum] and prunes the
+// blocks in between, recording each window and the schedule in the manifest.
+// A dry run only reports the windows to impactReport.
+func prune(src *ChainSource, sched schedule, upNum int, endNum int) error {
+	src.printHead()
 
-	// ReadHeaderNumber returns the header number assigned to a hash.
-	currHeight := rawdb.ReadHeaderNumber(ancientDb, currHeader)
-	fmt.Printf("currHeight: %d\n", *currHeight)
+	// Every pruned block needs its own state
+	if err := preflight(src, upNum, endNum, 1); err != nil {
+		return err
+	}
 
-	// Create in-memory trie database
-	triedb := trie.NewDatabase(ancientDb)
+	// Windows pruned with another schedule can't be mixed with this run
+	m, err := loadManifest()
+	if err != nil {
+		return err
+	}
+	switch s := sched.(type) {
+	case fixedSchedule:
+		if m.Interval != int(s) || m.Schedule != nil {
+			m = &manifest{Interval: int(s), Windows: map[uint64]*windowEntry{}}
+		}
+	case *adaptiveSchedule:
+		if m.Schedule == nil || m.Schedule.Metric != s.Metric || m.Schedule.Budget != s.Budget {
+			m = &manifest{Schedule: &adaptiveSchedule{Metric: s.Metric, Budget: s.Budget}, Windows: map[uint64]*windowEntry{}}
+		}
+		// A rerun over the same blocks may place its checkpoints elsewhere
+		for _, cp := range m.Schedule.merge(s) {
+			delete(m.Windows, cp)
+		}
+		// and a window kept above them loses the blocks they now cover
+		if high := s.Blocks[len(s.Blocks)-1]; impactReport == nil {
+			for cp, w := range m.Windows {
+				if cp <= high || w.low() > high {
+					continue
+				}
+				fmt.Printf("Window %v overlaps the new checkpoints, re-pruning it from block %d.\n", cp, high+1)
+				entry, err := pruneWindow(src, int(cp), int(high)+1)
+				if err != nil {
+					return err
+				}
+				m.Windows[cp] = entry
+			}
+			if err := m.save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	var est *planner
+	if impactReport != nil {
+		if est, err = newPlanner(src, sched); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("----------------------------------------------------------------")
 
+	// At every checkpoint we maintain the block state, the blocks down to the previous one are pruned
+	var total spaceUsage
+	var deleted int
+	var impact windowImpact
+	cps := sched.within(uint64(upNum), uint64(endNum))
+	for i := len(cps) - 1; i >= 0; i-- {
+		cp, low := int(cps[i]), upNum
+		if i > 0 {
+			low = int(cps[i-1]) + 1
+		}
+		entry, err := pruneWindow(src, cp, low)
+		if err != nil {
+			return err
+		}
+		total.add(entry.Space)
+		deleted += entry.Deleted
+		if est != nil {
+			w, err := estimateImpact(est, entry)
+			if err != nil {
+				return err
+			}
+			reportImpact(sched, "window", w)
+			impact.add(w)
+			continue
+		}
+		m.Windows[uint64(cp)] = entry
+		if err := m.save(); err != nil {
+			return err
+		}
+	}
+	if est != nil {
+		impact.Checkpoint, impact.Low = uint64(endNum), uint64(upNum)
+		reportImpact(sched, "total", impact)
+	} else if flattenCheckpoints {
+		// Queries of the range start from the checkpoint at or below upNum
+		for _, cp := range queryCheckpoints(sched, uint64(upNum), uint64(endNum)) {
+			if err := src.snaps.flatten(src, cp); err != nil {
+				if err := tolerate(err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if spaceReport != nil {
+		reportSpace("total", uint64(endNum), deleted, total)
+		fmt.Printf("Pruning deleted %v accounts and frees %v bytes (%v removed, %v added).\n",
+			deleted, total.freedBytes(), total.Removed.bytes(), total.Added.bytes())
+	}
+	return nil
+}
+
+// pruneWindow prunes the blocks from checkpoint cp down to low, writes their
+// deleted accounts into Accounts_<cp>.txt and returns the manifest entry. If
+// the canonical chain changes while the window is processed, it is redone.
+func pruneWindow(src *ChainSource, cp int, low int) (*windowEntry, error) {
+	for {
+		entry, err := pruneWindowOnce(src, cp, low)
+		if err != nil || entry.canonical(src.DB) {
+			return entry, err
+		}
+		fmt.Printf("Chain reorganised while pruning window %v, redo it.\n", cp)
+	}
+}
+
+func pruneWindowOnce(src *ChainSource, cp int, low int) (*windowEntry, error) {
 	// Checkpoint block state list
 	var influenced_account = map[common.Address]bool{}
 	var num_of_account = 0
-	var file (*os.File)
 
-	for i := endNum; i >= upNum; i-- {
+	// Create file indicating the deleted accounts, a dry run writes nothing
+	entry := &windowEntry{File: deletedFile(cp)}
+	var file io.Writer = io.Discard
+	if impactReport == nil {
+		f, err := os.OpenFile(entry.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		file = f
+	}
+
+	for i := cp; i >= low; i-- {
 		// set deleted account map and number for each block
 		var deleted_account = map[common.Address]bool{}
 		var total_del_account = 0
 
-		// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-		blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(i))
-
-		if blkHash == (common.Hash{}) {
-			fmt.Printf("Err: Block not found: %v\n", i)
+		blkHash, blkHeader, err := readHeader(src.DB, uint64(i))
+		if i == cp {
+			entry.Checkpoint = blockRef{Number: uint64(i), Hash: blkHash}
 		} else {
-			fmt.Printf("Etherscan url: https://etherscan.io/block/%v\n", i)
-			fmt.Printf("BlockHash: %x\n", blkHash)
+			entry.Blocks = append(entry.Blocks, blockRef{Number: uint64(i), Hash: blkHash})
 		}
+		var (
+			Trie    *trie.StateTrie
+			blkBody *types.Body
+		)
+		if err == nil {
+			if url := explorerURL(uint64(i)); url != "" {
+				fmt.Printf("Explorer url: %v\n", url)
+			}
+			fmt.Printf("BlockHash: %x\n", blkHash)
+			fmt.Printf("Block state root: 0x%x\n", blkHeader.Root)
 
-		// ReadHeader retrieves the block header corresponding to the hash.
-		blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(i))
-		fmt.Printf("Block state root: 0x%x\n", blkHeader.Root)
-
-		// Retrieve state root and construct the trie accordingly
-		Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
+			// Retrieve state root and construct the trie accordingly
+			Trie, err = trie.NewStateTrie(common.Hash{}, blkHeader.Root, src.TrieDB)
+			err = wrapTrieErr(err, uint64(i), blkHeader.Root)
+		}
+		if err == nil {
+			blkBody, err = readBody(src.DB, uint64(i))
+		}
 		if err != nil {
-			panic(err)
+			// A skipped block still gets its line so the file stays aligned
+			if err := tolerate(err); err != nil {
+				return nil, err
+			}
+			io.WriteString(file, "BLKEND\n")
+			continue
 		}
-
-		// ReadBody retrieves the block body corresponding to the hash.
-		blkBody := rawdb.ReadBody(ancientDb, blkHash, uint64(i))
 		fmt.Printf("BlkBody Tx size: %d\n", len(blkBody.Transactions))
 
-		// Every N blocks we maintain a checkpoint block
-		if i%N == 0 {
-			// Create file indicating the deleted accounts
-			file, err = os.OpenFile("H:/deleted/Accounts_"+fmt.Sprint(i)+".txt", os.O_WRONLY|os.O_CREATE, 0666)
-			if err != nil {
-				panic(err)
-			}
-			defer file.Close()
-
-			// first empty the map
-			for acc := range influenced_account {
-				delete(influenced_account, acc)
-			}
-			fmt.Printf("Last sliding window we have %v unique accounts.\n", num_of_account)
-			num_of_account = 0
-
-			// Then check each tx to find influenced account
+		if i == cp {
+			// Check each tx to find influenced account
 			for _, tx := range blkBody.Transactions {
 				// fmt.Printf("tx Hash: %v\n", tx.Hash())
-				txFrom := getFromAddr(tx, big.NewInt(int64(i)))
+				txFrom, err := getFromAddr(tx, big.NewInt(int64(i)))
+				if err != nil {
+					return nil, err
+				}
 				if !influenced_account[txFrom] {
 					influenced_account[txFrom] = true
 					// fmt.Printf("[Adding] tx From: %v\n", txFrom)
@@ -129,14 +313,17 @@ func DoPrune(cmdline []string) {
 			// Perform pruning
 			for _, tx := range blkBody.Transactions {
 				// fmt.Printf("tx Hash: %v\n", tx.Hash())
-				txFrom := getFromAddr(tx, big.NewInt(int64(i)))
+				txFrom, err := getFromAddr(tx, big.NewInt(int64(i)))
+				if err != nil {
+					return nil, err
+				}
 				if !influenced_account[txFrom] {
 					influenced_account[txFrom] = true
 					// fmt.Printf("[Adding] tx From: %v\n", txFrom)
 					num_of_account++
 				} else {
 					// Delete this account's state
-					err = Trie.TryDeleteAccount(txFrom.Bytes())
+					err = wrapTrieErr(Trie.TryDeleteAccount(txFrom.Bytes()), uint64(i), blkHeader.Root)
 					if err == nil {
 						if !deleted_account[txFrom] {
 							// fmt.Printf("[NewDel] tx From  : %v\n", txFrom)
@@ -144,8 +331,10 @@ func DoPrune(cmdline []string) {
 							deleted_account[txFrom] = true
 						}
 					} else {
-						fmt.Println(err)
 						fmt.Printf("[ErrDel] tx From  : %v\n", txFrom)
+						if err := tolerate(err); err != nil {
+							return nil, err
+						}
 					}
 				}
 				if tx.To() != nil {
@@ -157,9 +346,10 @@ func DoPrune(cmdline []string) {
 					} else {
 						// Delete this account's state
 						acc, err := Trie.TryGetAccount(txTo.Bytes())
+						err = wrapTrieErr(err, uint64(i), blkHeader.Root)
 						if err == nil {
 							if acc != nil && acc.CodeHash == nil && tx.Value().Cmp(big.NewInt(0)) == 1 {
-								err := Trie.TryDeleteAccount(txTo.Bytes())
+								err := wrapTrieErr(Trie.TryDeleteAccount(txTo.Bytes()), uint64(i), blkHeader.Root)
 								if err == nil {
 									if !deleted_account[txTo] {
 										// fmt.Printf("[NewDel] tx To  : %v\n", txTo)
@@ -167,28 +357,46 @@ func DoPrune(cmdline []string) {
 										deleted_account[txTo] = true
 									}
 								} else {
-									fmt.Println(err)
 									fmt.Printf("[ErrDel] tx To  : %v\n", txTo)
+									if err := tolerate(err); err != nil {
+										return nil, err
+									}
 								}
 							}
 						} else {
-							fmt.Println(err)
 							fmt.Printf("[ErrGet] tx To  : %v\n", txTo)
+							if err := tolerate(err); err != nil {
+								return nil, err
+							}
 						}
 					}
 				}
 			}
 		}
 		fmt.Printf("Block %v deleted %v accounts.\n", i, total_del_account)
+		entry.Deleted += total_del_account
+		if measuringSpace() && total_del_account > 0 {
+			// Compare the deleted paths of the original and the pruned trie
+			var deleted []common.Address
+			for acc := range deleted_account {
+				deleted = append(deleted, acc)
+			}
+			usage, err := measurePruning(src.TrieDB, blkHeader.Root, Trie, deleted, uint64(i))
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("Block %v frees %v nodes, %v bytes.\n", i, usage.Removed.nodes()-usage.Added.nodes(), usage.freedBytes())
+			reportSpace("block", uint64(i), total_del_account, usage)
+			entry.Space.add(usage)
+		}
 		for acc := range deleted_account {
-			file.WriteString(acc.String() + " ")
+			io.WriteString(file, acc.String()+" ")
 			delete(deleted_account, acc)
 		}
-		file.WriteString("BLKEND\n")
-		// ReadBlock retrieves an entire block corresponding to the hash
-		if blkHash != rawdb.ReadBlock(ancientDb, blkHash, uint64(i)).Hash() {
-			fmt.Println("Error! blkhash doesn't match the block")
-			return
+		io.WriteString(file, "BLKEND\n")
+		// The header read must be the one the canonical hash points to
+		if blkHash != blkHeader.Hash() {
+			return nil, fmt.Errorf("block %v: blkhash doesn't match the block", i)
 		}
 		// root, nodeset, err := Trie.Commit(true)
 		// if err != nil {
@@ -197,26 +405,30 @@ func DoPrune(cmdline []string) {
 		// fmt.Printf("Block %v now trie root = %v\n", i, root)
 		// if nodeset != nil {
 		// 	mergeNS := trie.NewWithNodeSet(nodeset)
-		// 	err = triedb.Update(mergeNS)
+		// 	err = src.TrieDB.Update(mergeNS)
 		// 	if err != nil {
 		// 		panic(err)
 		// 	}
-		// 	err = triedb.Commit(root, false, nil)
+		// 	err = src.TrieDB.Commit(root, false, nil)
 		// 	if err != nil {
 		// 		panic(err)
 		// 	}
 		// }
 		fmt.Println("----------------------------------------------------------------")
 	}
+	fmt.Printf("Sliding window %v has %v unique accounts.\n", cp, num_of_account)
+	entry.Accounts = num_of_account
+	reportSpace("window", uint64(cp), entry.Deleted, entry.Space)
+	return entry, nil
 }
 
-func getFromAddr(tx *types.Transaction, num *big.Int) common.Address {
-	var signer types.Signer = types.MakeSigner(params.MainnetChainConfig, num)
+func getFromAddr(tx *types.Transaction, num *big.Int) (common.Address, error) {
+	var signer types.Signer = types.MakeSigner(chainConfig, num)
 
 	from, err := types.Sender(signer, tx)
 	if err != nil {
-		panic(err)
+		return common.Address{}, fmt.Errorf("tx %v in block %v: %v", tx.Hash(), num, err)
 	}
 
-	return from
+	return from, nil
 }
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// readDeletedLines returns the addresses of every BLKEND line of a deleted-account file.
+func readDeletedLines(t *testing.T, cp int) [][]string {
+	t.Helper()
+
+	data, err := os.ReadFile(deletedFile(cp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[len(fields)-1] != "BLKEND" {
+			t.Fatalf("window %d: malformed line %q", cp, line)
+		}
+		lines = append(lines, fields[:len(fields)-1])
+	}
+	return lines
+}
+
+func TestPruneWindows(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Interval != 5 || len(m.Windows) != 4 {
+		t.Fatalf("manifest has interval %d and %d windows, want 5 and 4", m.Interval, len(m.Windows))
+	}
+	for _, cp := range []uint64{5, 10, 15, 20} {
+		w := m.Windows[cp]
+		if w == nil {
+			t.Fatalf("window %d missing from manifest", cp)
+		}
+		if w.Checkpoint.Hash != c.blocks[cp-1].Hash() {
+			t.Errorf("window %d: checkpoint hash %x, want %x", cp, w.Checkpoint.Hash, c.blocks[cp-1].Hash())
+		}
+		want := int(cp - w.low() + 1)
+		if lines := readDeletedLines(t, int(cp)); len(lines) != want {
+			t.Errorf("window %d: %d BLKEND lines, want %d", cp, len(lines), want)
+		}
+	}
+	if low := m.Windows[5].low(); low != 1 {
+		t.Errorf("first window starts at %d, want 1", low)
+	}
+}
+
+func TestPruneDeletesRepeatedSenders(t *testing.T) {
+	c := newTestChain(t, busyTransfers(10))
+	if err := prune(c.src, fixedSchedule(5), 6, 10); err != nil {
+		t.Fatal(err)
+	}
+	lines := readDeletedLines(t, 10)
+	if len(lines[0]) != 0 {
+		t.Errorf("checkpoint block deleted %v", lines[0])
+	}
+	// Every account already sent in the checkpoint block, so all of them go
+	for i, line := range lines[1:] {
+		if len(line) != len(c.addrs) {
+			t.Errorf("block %d deleted %v, want all %d senders", 9-i, line, len(c.addrs))
+		}
+	}
+	m, _ := loadManifest()
+	if m.Windows[10].Deleted != 4*len(c.addrs) {
+		t.Errorf("manifest counts %d deletions, want %d", m.Windows[10].Deleted, 4*len(c.addrs))
+	}
+}
+
+func TestPruneResetsEachWindow(t *testing.T) {
+	// Account 0 only sends in block 7 and block 4, which belong to different windows
+	txs := make([][]transfer, 10)
+	txs[6] = []transfer{{0, 1, 1}}
+	txs[3] = []transfer{{0, 1, 1}}
+	txs[2] = []transfer{{0, 1, 1}}
+	c := newTestChain(t, txs)
+	if err := prune(c.src, fixedSchedule(5), 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range readDeletedLines(t, 10) {
+		if len(line) != 0 {
+			t.Errorf("window 10 deleted %v, the sender was only seen once", line)
+		}
+	}
+	lines := readDeletedLines(t, 5)
+	if len(lines[1]) != 0 {
+		t.Errorf("block 4 deleted %v, the window should have been reset", lines[1])
+	}
+	if len(lines[2]) != 1 || common.HexToAddress(lines[2][0]) != c.addrs[0] {
+		t.Errorf("block 3 deleted %v, want %v", lines[2], c.addrs[0])
+	}
+}
+
+func TestRefreshRegeneratesReorgedWindow(t *testing.T) {
+	c := newTestChain(t, busyTransfers(10))
+	if err := prune(c.src, fixedSchedule(5), 6, 10); err != nil {
+		t.Fatal(err)
+	}
+	// Replace blocks 8 to 10 by empty ones
+	fork := c.extend(t, c.blocks[6], make([][]transfer, 3))
+
+	m, _ := loadManifest()
+	if stale := m.staleWindows(c.db, 1, 10); len(stale) != 1 || stale[0] != 10 {
+		t.Fatalf("stale windows %v, want [10]", stale)
+	}
+	if err := refreshWindows(c.src, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = loadManifest()
+	if m.Windows[10].Checkpoint.Hash != fork[2].Hash() {
+		t.Errorf("checkpoint hash %x, want the fork's %x", m.Windows[10].Checkpoint.Hash, fork[2].Hash())
+	}
+	lines := readDeletedLines(t, 10)
+	if len(lines[1]) != 0 || len(lines[2]) != 0 {
+		t.Errorf("empty fork blocks deleted %v and %v", lines[1], lines[2])
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	var buf bytes.Buffer
+	openImpactReport(&buf)
+	err := prune(c.src, fixedSchedule(5), 1, 20)
+	impactReport = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(manifestPath()); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the manifest: %v", err)
+	}
+	if _, err := os.Stat(deletedFile(20)); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote a deleted-account file: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header, four windows and the total
+	if len(rows) != 6 {
+		t.Fatalf("%d rows in the report, want 6", len(rows))
+	}
+	total := rows[5]
+	if total[0] != "5" || total[1] != "total" {
+		t.Errorf("last row %v, want the total of schedule 5", total)
+	}
+
+	// The real run deletes what the dry run announced
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := loadManifest()
+	deleted := 0
+	for _, w := range m.Windows {
+		deleted += w.Deleted
+	}
+	if got, _ := strconv.Atoi(total[7]); got != deleted || deleted == 0 {
+		t.Errorf("dry run reports %d deletions, prune made %d", got, deleted)
+	}
+	if freed, _ := strconv.Atoi(total[8]); freed <= 0 {
+		t.Errorf("dry run frees %d bytes", freed)
+	}
+	if cost, _ := strconv.Atoi(total[9]); cost <= 0 {
+		t.Errorf("dry run estimates a replay cost of %d", cost)
+	}
+}
@@ -1,231 +1,200 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"strconv"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/rawdb"
-	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func DoQuery(cmdline []string) {
+	if len(cmdline) > 0 && cmdline[0] == "aggregate" {
+		doAggregate(cmdline[1:])
+		return
+	}
+	if len(cmdline) > 0 && cmdline[0] == "prove" {
+		doProve(cmdline[1:])
+		return
+	}
+	fs := newFlagSet("query")
+	changesOnly := fs.Bool("changes", false, "range query: only report the blocks where the account changed")
+	show := fs.Bool("print", false, "range query: print the state of every reported block")
+	planned := fs.Bool("plan", false, "point query: also answer every block by the path the planner estimates cheapest")
+	explain := fs.Bool("explain", false, "point query: print the plan of every block, implies -plan")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
 	if len(cmdline) < 4 {
-		fmt.Println("Error! Must indicate at least the account hash, the block interval, and start/end block number.")
+		fmt.Println("Error! Must indicate at least the account hash, the block interval (or manifest), and start/end block number.")
 		return
 	}
-	inter, err := strconv.Atoi(cmdline[1])
+	sched, err := parseSchedule(cmdline[1])
 	if err != nil {
-		panic(err)
+		fmt.Println("Error!", err)
+		return
 	}
-	upNum, err := strconv.Atoi(cmdline[2])
+
+	src, err := OpenChainSource()
 	if err != nil {
-		panic(err)
+		fmt.Println("Error!", err)
+		return
 	}
-	endNum, err := strconv.Atoi(cmdline[3])
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[2], cmdline[3])
 	if err != nil {
-		panic(err)
+		fmt.Println("Error!", err)
+		return
 	}
-	if len(cmdline) == 5 {
-		// do the range query
-		rangeint, err := strconv.Atoi(cmdline[4])
-		if err != nil {
-			panic(err)
+
+	run := func() error {
+		if len(cmdline) == 5 {
+			// do the range query
+			rangeint, err := strconv.Atoi(cmdline[4])
+			if err != nil {
+				panic(err)
+			}
+			report := func(s BlockState) error {
+				if *show {
+					fmt.Printf("Account %v at %v\n", common.HexToAddress(cmdline[0]), s)
+				}
+				return nil
+			}
+			if err := originRangeQuery(src, cmdline[0], upNum, endNum, rangeint, *changesOnly, report); err != nil {
+				return err
+			}
+			fmt.Println("------------------------------------------------------------------")
+			return prunedRangeQuery(src, sched, cmdline[0], upNum, endNum, rangeint, *changesOnly, report)
 		}
-		originRangeQuery(cmdline[0], upNum, endNum, rangeint)
-		fmt.Println("------------------------------------------------------------------")
-		prunedRangeQuery(inter, cmdline[0], upNum, endNum, rangeint)
-	} else {
 		// do the point query
-		originPointQuery(cmdline[0], upNum, endNum)
+		if _, err := originPointQuery(src, cmdline[0], upNum, endNum); err != nil {
+			return err
+		}
 		fmt.Println("------------------------------------------------------------------")
-		prunedPointQuery(inter, cmdline[0], upNum, endNum)
+		if _, err := prunedPointQuery(src, sched, cmdline[0], upNum, endNum); err != nil {
+			return err
+		}
+		if !*planned && !*explain {
+			return nil
+		}
+		fmt.Println("------------------------------------------------------------------")
+		_, err := plannedPointQuery(src, sched, cmdline[0], upNum, endNum, *explain)
+		return err
+	}
+	if src.snaps == nil {
+		if err := run(); err != nil {
+			fmt.Println("Error!", err)
+		}
+		return
 	}
+	// Benchmark the trie and the snapshot reads on the same range, both from cold caches
+	for _, snap := range []bool{false, true} {
+		src.snaps.active = snap
+		src.resetCaches()
+		if snap {
+			fmt.Println("======================= Snapshot Reads =======================")
+		} else {
+			fmt.Println("========================= Trie Reads =========================")
+		}
+		if err := run(); err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+	}
+	fmt.Printf("Snapshot: %v.\n", src.snaps.Stats)
 }
 
-func originPointQuery(account string, upNum int, endNum int) {
-	// Open ethereum levelDB with ancient flatten data
-	ancientDb, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, 16, 1, ancientPath, "", false)
-	if err != nil {
-		panic(err)
+// originPointQuery reads the account from the original trie of every block in
+// [upNum, endNum] and returns its balance and nonce by block number.
+func originPointQuery(src *ChainSource, account string, upNum int, endNum int) (map[uint64]*types.StateAccount, error) {
+	src.printHead()
+	if err := preflight(src, upNum, endNum, 1); err != nil {
+		return nil, err
 	}
-	defer ancientDb.Close()
-
-	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
-	currHeader := rawdb.ReadHeadHeaderHash(ancientDb)
-	fmt.Printf("currHeader: %x\n", currHeader)
-
-	// ReadHeaderNumber returns the header number assigned to a hash.
-	currHeight := rawdb.ReadHeaderNumber(ancientDb, currHeader)
-	fmt.Printf("currHeight: %d\n", *currHeight)
-
-	// Create in-memory trie database
-	triedb := trie.NewDatabase(ancientDb)
 
 	fmt.Println("----------------------Origin Point Query----------------------")
-	startTime := time.Now()
-
-	var longestime = time.Duration(0)
-	var long2ndtime = time.Duration(0)
-	var shortestime = time.Duration(10000000)
-	var short2ndtime = time.Duration(10000000)
+	accounts := map[uint64]*types.StateAccount{}
+	stats := newQueryStats()
 	for i := upNum; i <= endNum; i++ {
 		roundTime := time.Now()
 
-		// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-		blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(i))
-
-		if blkHash == (common.Hash{}) {
-			fmt.Printf("Err: Block not found: %v\n", i)
-		}
-
-		// ReadHeader retrieves the block header corresponding to the hash.
-		blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(i))
-		// fmt.Printf("Block state root: 0x%x\n", blkHeader.Root)
-
 		// Retrieve state root and construct the trie accordingly
-		Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
-		if err != nil {
-			panic(err)
+		base, Trie, err := resolveState(src, uint64(i))
+		var acc *types.StateAccount
+		if err == nil {
+			acc, err = readAccount(src, Trie, common.HexToAddress(account), base)
 		}
-		_, err = Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-		// acc, err := Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-		if err != nil {
-			fmt.Println(err)
-		}
-		// else {
-		// 	fmt.Printf("Account 0x%x had balance %d in block %d.\n", common.HexToAddress(account), acc.Balance, i)
-		// }
-
-		roundElapsed := time.Since(roundTime) / time.Microsecond
-		if roundElapsed > longestime {
-			long2ndtime = longestime
-			longestime = roundElapsed
-		} else if roundElapsed > long2ndtime {
-			long2ndtime = roundElapsed
+		if err := tolerate(err); err != nil {
+			return nil, err
 		}
-		if roundElapsed < shortestime {
-			short2ndtime = shortestime
-			shortestime = roundElapsed
-		} else if roundElapsed > shortestime && roundElapsed < short2ndtime {
-			short2ndtime = roundElapsed
+		if acc != nil {
+			accounts[uint64(i)] = &types.StateAccount{Balance: new(big.Int).Set(acc.Balance), Nonce: acc.Nonce}
+			// fmt.Printf("Account 0x%x had balance %d in block %d.\n", common.HexToAddress(account), acc.Balance, i)
 		}
+
+		stats.record(time.Since(roundTime))
 		if i%10000 == 0 {
 			fmt.Printf("Block %d passed.\n", i)
 		}
 	}
 
-	elapsedTime := time.Since(startTime) / time.Microsecond
-	fmt.Printf("Total query time: %d us, average %d us.\n", elapsedTime, elapsedTime/time.Duration(endNum-upNum+1))
-	fmt.Printf("Longest query time: %d us, shortest %d us.\n", long2ndtime, short2ndtime)
+	src.finishQuery(timingOriginPoint, stats)
+	src.cache.printStats()
+	return accounts, nil
 }
 
-func originRangeQuery(account string, upNum int, endNum int, rangeint int) {
-	// Open ethereum levelDB with ancient flatten data
-	ancientDb, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, 16, 1, ancientPath, "", false)
-	if err != nil {
-		panic(err)
+// originRangeQuery answers the range [i, i+rangeint) for every i in steps of
+// rangeint from the original tries and streams the states to fn.
+func originRangeQuery(src *ChainSource, account string, upNum int, endNum int, rangeint int, changesOnly bool, fn func(BlockState) error) error {
+	src.printHead()
+	if err := preflight(src, upNum, endNum, 1); err != nil {
+		return err
 	}
-	defer ancientDb.Close()
-
-	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
-	currHeader := rawdb.ReadHeadHeaderHash(ancientDb)
-	fmt.Printf("currHeader: %x\n", currHeader)
-
-	// ReadHeaderNumber returns the header number assigned to a hash.
-	currHeight := rawdb.ReadHeaderNumber(ancientDb, currHeader)
-	fmt.Printf("currHeight: %d\n", *currHeight)
-
-	// Create in-memory trie database
-	triedb := trie.NewDatabase(ancientDb)
 
 	fmt.Println("----------------------Origin Range Query----------------------")
-	startTime := time.Now()
-
-	var longestime = time.Duration(0)
-	var long2ndtime = time.Duration(0)
-	var shortestime = time.Duration(10000000)
-	var short2ndtime = time.Duration(10000000)
+	stats := newQueryStats()
 	for i := upNum; i <= endNum; i += rangeint {
 		roundTime := time.Now()
 
-		for j := i; j <= i+rangeint && j <= endNum; j++ {
-			// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-			blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(j))
-
-			if blkHash == (common.Hash{}) {
-				fmt.Printf("Err: Block not found: %v\n", j)
-			}
-
-			// ReadHeader retrieves the block header corresponding to the hash.
-			blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(j))
-			// fmt.Printf("Block state root: 0x%x\n", blkHeader.Root)
-
-			// Retrieve state root and construct the trie accordingly
-			Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
-			if err != nil {
-				panic(err)
-			}
-			_, err = Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-			// acc, err := Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-			if err != nil {
-				fmt.Println(err)
-			}
-			// else {
-			// 	fmt.Printf("Account 0x%x had balance %d in block %d.\n", common.HexToAddress(account), acc.Balance, i)
-			// }
+		if err := OriginRange(src, common.HexToAddress(account), uint64(i), uint64(rangeEnd(i, rangeint, endNum)), changesOnly, fn); err != nil {
+			return err
 		}
 
-		roundElapsed := time.Since(roundTime) / time.Microsecond
-		if roundElapsed > longestime {
-			long2ndtime = longestime
-			longestime = roundElapsed
-		} else if roundElapsed > long2ndtime {
-			long2ndtime = roundElapsed
-		}
-		if roundElapsed < shortestime {
-			short2ndtime = shortestime
-			shortestime = roundElapsed
-		} else if roundElapsed > shortestime && roundElapsed < short2ndtime {
-			short2ndtime = roundElapsed
-		}
+		stats.record(time.Since(roundTime))
 		if i%10000 == 0 {
 			fmt.Printf("Block %d passed.\n", i)
 		}
 	}
 
-	elapsedTime := time.Since(startTime) / time.Microsecond
-	fmt.Printf("Total query time: %d us, average %d us.\n", elapsedTime, elapsedTime/time.Duration((endNum-upNum)/rangeint+1))
-	fmt.Printf("Longest query time: %d us, shortest %d us.\n", long2ndtime, short2ndtime)
+	src.finishQuery(timingOriginRange, stats)
+	src.cache.printStats()
+	return nil
 }
 
-func prunedPointQuery(inter int, account string, upNum int, endNum int) {
-	// Open ethereum levelDB with ancient flatten data
-	ancientDb, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, 16, 1, ancientPath, "", false)
-	if err != nil {
-		panic(err)
+// prunedPointQuery rebuilds the account of every block from the closer
+// checkpoint, replaying forward from the one below it or backward from the
+// next one, and returns its balance and nonce by block number.
+func prunedPointQuery(src *ChainSource, sched schedule, account string, upNum int, endNum int) (map[uint64]*types.StateAccount, error) {
+	src.printHead()
+	if err := preflightCheckpoints(src, sched, upNum, endNum); err != nil {
+		return nil, err
 	}
-	defer ancientDb.Close()
-
-	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
-	currHeader := rawdb.ReadHeadHeaderHash(ancientDb)
-	fmt.Printf("currHeader: %x\n", currHeader)
-
-	// ReadHeaderNumber returns the header number assigned to a hash.
-	currHeight := rawdb.ReadHeaderNumber(ancientDb, currHeader)
-	fmt.Printf("currHeight: %d\n", *currHeight)
 
-	// Create in-memory trie database
-	triedb := trie.NewDatabase(ancientDb)
+	// Regenerate pruned windows invalidated by a reorg before relying on them
+	if err := refreshWindows(src, upNum, endNum); err != nil {
+		return nil, err
+	}
 
 	// Read bloom filter
 	var prunedAddresses []map[common.Address]bool
 	// prunedAddresses = append(prunedAddresses, map[common.Address]bool{})
 	// cpBlockNum := upNum - upNum%200
 
-	// file, err := os.OpenFile(bloomPath+fmt.Sprint(cpBlockNum+200)+".txt", os.O_RDONLY, 0666)
+	// file, err := os.OpenFile(deletedFile(cpBlockNum+200), os.O_RDONLY, 0666)
 	// if err != nil {
 	// 	panic(err)
 	// }
@@ -250,19 +219,21 @@ func prunedPointQuery(inter int, account string, upNum int, endNum int) {
 	for i := upNum; i <= endNum; i++ {
 		prunedAddresses = append(prunedAddresses, map[common.Address]bool{})
 
-		// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-		blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(i))
-		if blkHash == (common.Hash{}) {
-			fmt.Printf("Err: Internal Block not found: %v\n", i)
+		blkBody, err := readBody(src.DB, uint64(i))
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		// ReadBody retrieves the block body corresponding to the hash.
-		blkBody := rawdb.ReadBody(ancientDb, blkHash, uint64(i))
-
 		// Retrieve transactions and perform rebuilding
 		for _, tx := range blkBody.Transactions {
 			// fmt.Printf("tx Hash: %v\n", tx.Hash())
-			txFrom := getFromAddr(tx, big.NewInt(int64(i)))
+			txFrom, err := getFromAddr(tx, big.NewInt(int64(i)))
+			if err != nil {
+				return nil, err
+			}
 			prunedAddresses[i-upNum][txFrom] = true
 			if tx.To() != nil {
 				txTo := *(tx.To())
@@ -274,276 +245,92 @@ func prunedPointQuery(inter int, account string, upNum int, endNum int) {
 	fmt.Printf("Bloom time: %d us.\n", bloomElapsed)
 
 	fmt.Println("----------------------Pruned Point Query----------------------")
-	startTime := time.Now()
-
-	var longestime = time.Duration(0)
-	var long2ndtime = time.Duration(0)
-	var shortestime = time.Duration(10000000)
-	var short2ndtime = time.Duration(10000000)
-
-	var internalTime = time.Duration(0)
-	for i := upNum; i < endNum; i += inter { // i: cpBlk
-		for j := i; j < i+inter; j++ { // j: iterate queried blk
-			roundTime := time.Now()
-
-			// ReadCanonicalHash retrieves the hash assigned to a canonical1 block number.
-			blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(i))
-
-			if blkHash == (common.Hash{}) {
-				fmt.Printf("Err: Checkpoint Block not found: %v\n", i)
-			}
-
-			// ReadHeader retrieves the block header corresponding to the hash.
-			blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(i))
-			// fmt.Printf("Checkpoint Block state root: 0x%x\n", blkHeader.Root)
+	accounts := map[uint64]*types.StateAccount{}
+	stats := newQueryStats()
+	for j := upNum; j <= endNum; j++ { // j: iterate queried blk
+		roundTime := time.Now()
 
-			// Retrieve state root and construct the trie accordingly
-			Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
-			if err != nil {
-				panic(err)
+		// Retrieve the checkpoint state, or the nearest one available, reverted
+		// down to this block if the next checkpoint is closer
+		var internalStart = time.Now()
+		base, now, err := startLedger(src, sched, common.HexToAddress(account), uint64(j))
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return nil, err
 			}
-			acc, err := Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-			if err != nil {
-				fmt.Println(err)
+			continue
+		}
+		for k := int(base) + 1; k <= j && err == nil; k++ {
+			// check bloom filter
+			//if prunedAddresses[k-upNum][common.HexToAddress(account)] {
+			// A gap in the replayed blocks would corrupt the balance, never skip it
+			now, err = replayBlock(src.DB, uint64(k), common.HexToAddress(account), now, nil)
+			//}
+		}
+		if err != nil {
+			// Except a missed credit, which only makes this block unknown
+			if !errors.Is(err, ErrMissedCredit) {
+				return nil, err
 			}
-			var nowBalance = acc.Balance
-
-			var internalStart = time.Now()
-			for k := i + 1; k <= j; k++ {
-				// check bloom filter
-				//if prunedAddresses[k-upNum][common.HexToAddress(account)] {
-				// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-				blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(k))
-
-				if blkHash == (common.Hash{}) {
-					fmt.Printf("Err: Internal Block not found: %v\n", k)
-				}
-
-				// ReadBody retrieves the block body corresponding to the hash.
-				blkBody := rawdb.ReadBody(ancientDb, blkHash, uint64(k))
-				// fmt.Printf("BlkBody Tx size: %d\n", len(blkBody.Transactions))
-
-				// Retrieve transactions and perform rebuilding
-				for _, tx := range blkBody.Transactions {
-					// fmt.Printf("tx Hash: %v\n", tx.Hash())
-					txFrom := getFromAddr(tx, big.NewInt(int64(k)))
-					if txFrom == common.HexToAddress(account) {
-						nowBalance.Sub(nowBalance, tx.Value())
-						nowBalance.Sub(nowBalance, tx.GasPrice().Mul(tx.GasPrice(), big.NewInt(21000)))
-					} else if tx.To() != nil {
-						txTo := *(tx.To())
-						if txTo == common.HexToAddress(account) {
-							nowBalance.Add(nowBalance, tx.Value())
-						}
-					}
-				}
-				//}
+			if err := tolerate(err); err != nil {
+				return nil, err
 			}
+			continue
+		}
 
-			internalTime += time.Since(internalStart)
-			// fmt.Printf("Account 0x%x had balance %d in block %d.\n", common.HexToAddress(account), nowBalance, i)
+		stats.Internal += time.Since(internalStart)
+		accounts[uint64(j)] = &types.StateAccount{Balance: now.Balance(), Nonce: now.Nonce()}
+		// fmt.Printf("Account 0x%x had balance %d in block %d.\n", common.HexToAddress(account), now.Balance(), i)
 
-			roundElapsed := time.Since(roundTime) / time.Microsecond
-			//fmt.Printf("Block %d time: %d. sub: %d, inter: %d\n", i, roundElapsed, i-localCpBlockNum, inter)
-			if roundElapsed > longestime {
-				long2ndtime = longestime
-				longestime = roundElapsed
-			} else if roundElapsed > long2ndtime {
-				long2ndtime = roundElapsed
-			}
-			if roundElapsed < shortestime {
-				short2ndtime = shortestime
-				shortestime = roundElapsed
-			} else if roundElapsed > shortestime && roundElapsed < short2ndtime {
-				short2ndtime = roundElapsed
-			}
-			if j%10000 == 0 {
-				fmt.Printf("Block %d passed.\n", j)
-			}
+		//fmt.Printf("Block %d time: %d. sub: %d\n", j, time.Since(roundTime), j-localCpBlockNum)
+		stats.record(time.Since(roundTime))
+		if j%10000 == 0 {
+			fmt.Printf("Block %d passed.\n", j)
 		}
 	}
 
-	elapsedTime := time.Since(startTime) / time.Microsecond
-	fmt.Printf("Total query time: %d us, internal time: %d us, average %d us.\n", elapsedTime, internalTime/time.Microsecond, elapsedTime/time.Duration(endNum-upNum+1))
-	fmt.Printf("Longest query time: %d us, shortest %d us.\n", long2ndtime, short2ndtime)
+	src.finishQuery(timingPrunedPoint, stats)
+	src.cache.printStats()
+	return accounts, nil
 }
 
-func prunedRangeQuery(inter int, account string, upNum int, endNum int, rangeint int) {
-	// Open ethereum levelDB with ancient flatten data
-	ancientDb, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, 16, 1, ancientPath, "", false)
-	if err != nil {
-		panic(err)
+// prunedRangeQuery answers the same ranges as originRangeQuery from the
+// checkpoint tries plus replay.
+func prunedRangeQuery(src *ChainSource, sched schedule, account string, upNum int, endNum int, rangeint int, changesOnly bool, fn func(BlockState) error) error {
+	src.printHead()
+	if err := preflightCheckpoints(src, sched, upNum, endNum); err != nil {
+		return err
 	}
-	defer ancientDb.Close()
-
-	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
-	currHeader := rawdb.ReadHeadHeaderHash(ancientDb)
-	fmt.Printf("currHeader: %x\n", currHeader)
 
-	// ReadHeaderNumber returns the header number assigned to a hash.
-	currHeight := rawdb.ReadHeaderNumber(ancientDb, currHeader)
-	fmt.Printf("currHeight: %d\n", *currHeight)
-
-	// Create in-memory trie database
-	triedb := trie.NewDatabase(ancientDb)
-
-	// Read bloom filter
-	var prunedAddresses []map[common.Address]bool
-	// prunedAddresses = append(prunedAddresses, map[common.Address]bool{})
-	cpBlockNum := upNum - upNum%inter
-
-	// file, err := os.OpenFile(bloomPath+fmt.Sprint(cpBlockNum+200)+".txt", os.O_RDONLY, 0666)
-	// if err != nil {
-	// 	panic(err)
-	// }
-	// defer file.Close()
-
-	// scanner := bufio.NewScanner(file)
-	// scanner.Split(bufio.ScanWords)
-	// var i = 0
-	// for scanner.Scan() {
-	// 	str := scanner.Text()
-	// 	if str == "BLKEND" {
-	// 		i++
-	// 		prunedAddresses = append(prunedAddresses, map[common.Address]bool{})
-	// 	} else {
-	// 		prunedAddresses[i][common.HexToAddress(str)] = true
-	// 	}
-	// }
-	// fmt.Printf("prunedAddress length = %d\n", len(prunedAddresses))
-
-	for i := cpBlockNum + 1; i <= endNum; i++ {
-		prunedAddresses = append(prunedAddresses, map[common.Address]bool{})
-
-		// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-		blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(i))
-		if blkHash == (common.Hash{}) {
-			fmt.Printf("Err: Internal Block not found: %v\n", i)
-		}
-
-		// ReadBody retrieves the block body corresponding to the hash.
-		blkBody := rawdb.ReadBody(ancientDb, blkHash, uint64(i))
-
-		// Retrieve transactions and perform rebuilding
-		for _, tx := range blkBody.Transactions {
-			// fmt.Printf("tx Hash: %v\n", tx.Hash())
-			txFrom := getFromAddr(tx, big.NewInt(int64(i)))
-			prunedAddresses[i-cpBlockNum-1][txFrom] = true
-			if tx.To() != nil {
-				txTo := *(tx.To())
-				prunedAddresses[i-cpBlockNum-1][txTo] = true
-			}
-		}
+	// Regenerate pruned windows invalidated by a reorg before relying on them
+	if err := refreshWindows(src, upNum, endNum); err != nil {
+		return err
 	}
 
 	fmt.Println("----------------------Pruned Range Query----------------------")
-	startTime := time.Now()
-
-	var longestime = time.Duration(0)
-	var long2ndtime = time.Duration(0)
-	var shortestime = time.Duration(10000000)
-	var short2ndtime = time.Duration(10000000)
+	stats := newQueryStats()
 	for i := upNum; i <= endNum; i += rangeint {
-		localCpBlockNum := i - i%inter
 		roundTime := time.Now()
 
-		// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-		blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(localCpBlockNum))
-
-		if blkHash == (common.Hash{}) {
-			fmt.Printf("Err: Checkpoint Block not found: %v\n", localCpBlockNum)
-		}
-
-		// ReadHeader retrieves the block header corresponding to the hash.
-		blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(localCpBlockNum))
-		// fmt.Printf("Checkpoint Block state root: 0x%x\n", blkHeader.Root)
-
-		// Retrieve state root and construct the trie accordingly
-		Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
-		if err != nil {
-			panic(err)
-		}
-		acc, err := Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		var nowBalance = acc.Balance
-		for j := localCpBlockNum + 1; j <= i+rangeint && j <= endNum; j += inter {
-			var k = j
-			for ; k < j+inter-1 && k <= endNum; k++ {
-				if prunedAddresses[k-cpBlockNum-1][common.HexToAddress(account)] {
-					// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-					blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(k))
-
-					if blkHash == (common.Hash{}) {
-						fmt.Printf("Err: Internal Block not found: %v\n", k)
-					}
-
-					// ReadBody retrieves the block body corresponding to the hash.
-					blkBody := rawdb.ReadBody(ancientDb, blkHash, uint64(k))
-					// fmt.Printf("BlkBody Tx size: %d\n", len(blkBody.Transactions))
-
-					// Retrieve transactions and perform rebuilding
-					for _, tx := range blkBody.Transactions {
-						// fmt.Printf("tx Hash: %v\n", tx.Hash())
-						txFrom := getFromAddr(tx, big.NewInt(int64(i)))
-						if txFrom == common.HexToAddress(account) {
-							nowBalance.Sub(nowBalance, tx.Value())
-							nowBalance.Sub(nowBalance, tx.GasPrice().Mul(tx.GasPrice(), big.NewInt(21000)))
-						} else if tx.To() != nil {
-							txTo := *(tx.To())
-							if txTo == common.HexToAddress(account) {
-								nowBalance.Add(nowBalance, tx.Value())
-							}
-						}
-					}
-				}
-			}
-			if k == j+inter-1 {
-				// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
-				blkHash := rawdb.ReadCanonicalHash(ancientDb, uint64(k))
-
-				if blkHash == (common.Hash{}) {
-					fmt.Printf("Err: Checkpoint Block not found: %v\n", k)
-				}
-
-				// ReadHeader retrieves the block header corresponding to the hash.
-				blkHeader := rawdb.ReadHeader(ancientDb, blkHash, uint64(k))
-				// fmt.Printf("Checkpoint Block state root: 0x%x\n", blkHeader.Root)
-
-				// Retrieve state root and construct the trie accordingly
-				Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, triedb)
-				if err != nil {
-					panic(err)
-				}
-				acc, err := Trie.TryGetAccount(common.HexToAddress(account).Bytes())
-				if err != nil {
-					fmt.Println(err)
-				}
-				nowBalance = acc.Balance
-			}
+		if err := PrunedRange(src, sched, common.HexToAddress(account), uint64(i), uint64(rangeEnd(i, rangeint, endNum)), changesOnly, fn); err != nil {
+			return err
 		}
 
-		roundElapsed := time.Since(roundTime) / time.Microsecond
-		if roundElapsed > longestime {
-			long2ndtime = longestime
-			longestime = roundElapsed
-		} else if roundElapsed > long2ndtime {
-			long2ndtime = roundElapsed
-		}
-		if roundElapsed < shortestime {
-			short2ndtime = shortestime
-			shortestime = roundElapsed
-		} else if roundElapsed > shortestime && roundElapsed < short2ndtime {
-			short2ndtime = roundElapsed
-		}
+		stats.record(time.Since(roundTime))
 		if i%10000 == 0 {
 			fmt.Printf("Block %d passed.\n", i)
 		}
 	}
 
-	elapsedTime := time.Since(startTime) / time.Microsecond
-	fmt.Printf("Total query time: %d us, average %d us.\n", elapsedTime, elapsedTime/time.Duration((endNum-upNum)/rangeint+1))
-	fmt.Printf("Longest query time: %d us, shortest %d us.\n", long2ndtime, short2ndtime)
+	src.finishQuery(timingPrunedRange, stats)
+	src.cache.printStats()
+	return nil
+}
+
+// rangeEnd returns the last block of the sub-range starting at i.
+func rangeEnd(i int, rangeint int, endNum int) int {
+	if i+rangeint-1 < endNum {
+		return i + rangeint - 1
+	}
+	return endNum
 }
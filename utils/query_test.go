@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPrunedPointQueryMatchesOrigin(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range append([]common.Address{c.miner}, c.addrs...) {
+		origin, err := originPointQuery(c.src, addr.Hex(), 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pruned, err := prunedPointQuery(c.src, fixedSchedule(5), addr.Hex(), 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(origin) != 20 {
+			t.Fatalf("%v: origin answered %d blocks, want 20", addr, len(origin))
+		}
+		for n, want := range origin {
+			got := pruned[n]
+			if got == nil || got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce {
+				t.Errorf("%v at block %d: pruned %+v, origin %+v", addr, n, got, want)
+			}
+		}
+		if origin[1].Balance.Cmp(origin[20].Balance) == 0 {
+			t.Errorf("%v: balance never changed, the chain doesn't exercise replay", addr)
+		}
+	}
+}
+
+func TestRangeQueriesRun(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	var origin, pruned []BlockState
+	collect := func(states *[]BlockState) func(BlockState) error {
+		return func(s BlockState) error {
+			*states = append(*states, s)
+			return nil
+		}
+	}
+	if err := originRangeQuery(c.src, c.addrs[0].Hex(), 5, 20, 4, false, collect(&origin)); err != nil {
+		t.Fatal(err)
+	}
+	if err := prunedRangeQuery(c.src, fixedSchedule(5), c.addrs[0].Hex(), 5, 20, 4, false, collect(&pruned)); err != nil {
+		t.Fatal(err)
+	}
+	if len(origin) != 16 || len(pruned) != 16 {
+		t.Fatalf("range queries answered %d and %d blocks, want 16", len(origin), len(pruned))
+	}
+}
+
+func TestRangeEnginesAgree(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	for _, addr := range append([]common.Address{c.miner}, c.addrs...) {
+		for _, changesOnly := range []bool{false, true} {
+			var origin, pruned []BlockState
+			err := OriginRange(c.src, addr, 3, 18, changesOnly, func(s BlockState) error {
+				origin = append(origin, s)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = PrunedRange(c.src, fixedSchedule(5), addr, 3, 18, changesOnly, func(s BlockState) error {
+				pruned = append(pruned, s)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changesOnly && len(origin) != 16 {
+				t.Fatalf("%v: origin streamed %d blocks, want 16", addr, len(origin))
+			}
+			if len(origin) != len(pruned) {
+				t.Fatalf("%v (changes %v): origin streamed %d states, pruned %d", addr, changesOnly, len(origin), len(pruned))
+			}
+			for i := range origin {
+				if origin[i].Number != pruned[i].Number || !origin[i].sameAs(pruned[i]) {
+					t.Errorf("%v (changes %v): origin %v, pruned %v", addr, changesOnly, origin[i], pruned[i])
+				}
+			}
+		}
+	}
+}
+
+func TestReplayDetectsNonceGap(t *testing.T) {
+	c := newTestChain(t, busyTransfers(4))
+	_, acc, err := checkpointAccount(c.src, c.addrs[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newLedger(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skipping block 2 leaves the sender's nonce behind its transactions in block 3
+	if _, err := replayBlock(c.src.DB, 3, c.addrs[0], l, nil); !errors.Is(err, ErrNonceGap) {
+		t.Fatalf("replay over a skipped block: got %v, want a nonce gap", err)
+	}
+	if l, err = replayBlock(c.src.DB, 2, c.addrs[0], l, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayBlock(c.src.DB, 3, c.addrs[0], l, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackwardReplayAgrees(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	for _, addr := range append([]common.Address{c.miner, {0x01}}, c.addrs...) {
+		var origin []BlockState
+		err := OriginRange(c.src, addr, 0, 20, false, func(s BlockState) error {
+			origin = append(origin, s)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Revert every block from the head down to the genesis
+		_, now, err := checkpointLedger(c.src, addr, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := uint64(20); k > 0; k-- {
+			if now, err = revertBlock(c.src.DB, k, addr, now); err != nil {
+				t.Fatalf("%v: revert block %d: %v", addr, k, err)
+			}
+			if want := origin[k-1]; now.Balance().Cmp(want.Balance) != 0 || now.Nonce() != want.Nonce {
+				t.Fatalf("%v: reverted to %v nonce %d, origin %v", addr, now.Balance(), now.Nonce(), want)
+			}
+		}
+
+		// Both directions give the same state of every block
+		for _, backward := range []bool{false, true} {
+			backwardReplay = backward
+			for n := uint64(0); n <= 20; n++ {
+				l, err := ledgerAt(c.src, fixedSchedule(10), addr, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := origin[n]; l.Balance().Cmp(want.Balance) != 0 || l.Nonce() != want.Nonce {
+					t.Errorf("%v block %d (backward %v): %v nonce %d, origin %v", addr, n, backward, l.Balance(), l.Nonce(), want)
+				}
+			}
+		}
+		backwardReplay = true
+	}
+}
+
+func TestRevertDetectsNonceGap(t *testing.T) {
+	c := newTestChain(t, busyTransfers(4))
+	_, now, err := checkpointLedger(c.src, c.addrs[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 4 sent 2 transactions of account 0, one nonce too few is a gap
+	now, _ = now.unsend()
+	if _, err := revertBlock(c.src.DB, 4, c.addrs[0], now); !errors.Is(err, ErrNonceGap) {
+		t.Errorf("revert from a wrong nonce gives %v", err)
+	}
+}
+
+func TestReplayMissedInternalCredit(t *testing.T) {
+	src, recipient := newForwarderChain(t)
+	origin, err := originPointQuery(src, recipient.Hex(), 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin[5] == nil || origin[5].Balance.Sign() == 0 {
+		t.Fatal("the forwarder didn't pay the recipient")
+	}
+
+	// Streams skip to the next checkpoint instead of aborting
+	var states []BlockState
+	if err := PrunedRange(src, fixedSchedule(5), recipient, 1, 5, false, func(s BlockState) error {
+		states = append(states, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	last := states[len(states)-1]
+	if last.Number != 5 || last.Balance.Cmp(origin[5].Balance) != 0 {
+		t.Errorf("range ends at %v, origin has %v at block 5", last, origin[5].Balance)
+	}
+	var rows []historyRow
+	if err := prunedHistory(src, fixedSchedule(5), recipient, 1, 5, func(row historyRow) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || rows[len(rows)-1].Block != 5 || rows[len(rows)-1].Balance != origin[5].Balance.String() {
+		t.Errorf("history %+v doesn't resync to %v at block 5", rows, origin[5].Balance)
+	}
+	if resync := rows[len(rows)-1]; resync.Tx != (common.Hash{}) {
+		t.Errorf("resync row %+v carries a transaction", resync)
+	}
+	// The same jump is no reward of the aggregate
+	a, err := AggregateRange(src, fixedSchedule(5), recipient, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Rewards.Sign() != 0 || a.MaxBalance.Cmp(origin[5].Balance) != 0 {
+		t.Errorf("aggregate rewards %v, max balance %v", a.Rewards, a.MaxBalance)
+	}
+
+	// A point query of the block the debit can't be covered in follows the policy
+	if _, err := prunedPointQuery(src, fixedSchedule(5), recipient.Hex(), 1, 5); !errors.Is(err, ErrMissedCredit) {
+		t.Errorf("stop policy: %v, want a missed credit", err)
+	}
+	onMissing = policySkip
+	pruned, err := prunedPointQuery(src, fixedSchedule(5), recipient.Hex(), 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned[2] != nil {
+		t.Errorf("block 2 answered %v despite the missed credit", pruned[2].Balance)
+	}
+	for _, n := range []uint64{3, 4, 5} {
+		if pruned[n] == nil || pruned[n].Balance.Cmp(origin[n].Balance) != 0 {
+			t.Errorf("block %d: pruned %v, origin %v", n, pruned[n], origin[n].Balance)
+		}
+	}
+}
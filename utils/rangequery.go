@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BlockState is the balance and nonce of an account once a block is applied.
+type BlockState struct {
+	Number  uint64
+	Balance *big.Int
+	Nonce   uint64
+}
+
+func (s BlockState) String() string {
+	return fmt.Sprintf("block %d: balance %v, nonce %d", s.Number, s.Balance, s.Nonce)
+}
+
+func (s BlockState) sameAs(o BlockState) bool {
+	return s.Balance.Cmp(o.Balance) == 0 && s.Nonce == o.Nonce
+}
+
+// stateStream passes states on to fn, dropping the unchanged ones if
+// changesOnly is set. The first state is always passed so the caller knows
+// where the range starts.
+func stateStream(changesOnly bool, fn func(BlockState) error) func(BlockState) error {
+	var (
+		last    BlockState
+		started bool
+	)
+	return func(s BlockState) error {
+		if changesOnly && started && s.sameAs(last) {
+			return nil
+		}
+		last, started = s, true
+		return fn(s)
+	}
+}
+
+// OriginRange streams the state of account at every block in [from, to] read
+// from the original trie of that block. With changesOnly only the first block
+// and the blocks where the state changed are streamed. An account that doesn't
+// exist yet has an empty state. Blocks skipped by the missing-data policy are
+// not streamed.
+func OriginRange(src *ChainSource, account common.Address, from uint64, to uint64, changesOnly bool, fn func(BlockState) error) error {
+	emit := stateStream(changesOnly, fn)
+	for n := from; n <= to; n++ {
+		base, Trie, err := resolveState(src, n)
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		acc, err := readAccount(src, Trie, account, base)
+		if errors.Is(err, ErrAccountAbsent) {
+			acc, err = emptyAccount(), nil
+		}
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := emit(BlockState{Number: n, Balance: new(big.Int).Set(acc.Balance), Nonce: acc.Nonce}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrunedRange streams the same states as OriginRange but only reads the
+// checkpoint tries sched places and replays the blocks in between. The start
+// is reverted from the next checkpoint if that one is closer. At each
+// checkpoint the replayed state is replaced by the one in its trie.
+func PrunedRange(src *ChainSource, sched schedule, account common.Address, from uint64, to uint64, changesOnly bool, fn func(BlockState) error) error {
+	return prunedReplay(src, sched, account, from, to, nil, stateStream(changesOnly, fn))
+}
+
+// prunedReplay is the loop behind PrunedRange, AggregateRange and the pruned
+// history. Besides the state after every block in [from, to] it passes the
+// replayed changes of those blocks to events if set, and a synced event
+// wherever the state jumps to a checkpoint that differs from the replay.
+func prunedReplay(src *ChainSource, sched schedule, account common.Address, from uint64, to uint64, events func(replayEvent), states func(BlockState) error) error {
+	var emit func(replayEvent)
+	if events != nil {
+		emit = func(ev replayEvent) {
+			if ev.Block >= from {
+				events(ev)
+			}
+		}
+	}
+	// Retrieve the checkpoint state, or the nearest one available. Changes of
+	// block from are wanted, so a start from the next checkpoint reverts it too.
+	target := from
+	if events != nil && from > 0 {
+		target = from - 1
+	}
+	base, now, err := startLedger(src, sched, account, target)
+	if err != nil {
+		return err
+	}
+	if base == from {
+		if err := states(BlockState{Number: from, Balance: now.Balance(), Nonce: now.Nonce()}); err != nil {
+			return err
+		}
+	}
+	sync := func(k uint64, synced ledger) {
+		if emit != nil && synced != now {
+			delta := new(big.Int).Sub(synced.Balance(), now.Balance())
+			emit(replayEvent{Block: k, Delta: delta, Balance: synced.Balance(), Nonce: synced.Nonce(), Synced: true})
+		}
+		now = synced
+	}
+	for k := base + 1; k <= to; k++ {
+		next, err := replayBlock(src.DB, k, account, now, emit)
+		if errors.Is(err, ErrMissedCredit) {
+			// The states up to the next checkpoint are unknown, leave them out
+			k, next, err = resyncLedger(src, sched, account, k, err)
+			if err == nil {
+				sync(k, next)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		now = next
+		if sched.isCheckpoint(k) {
+			// A fallback state of an earlier block says nothing about this one
+			cp, synced, err := checkpointLedger(src, account, k)
+			if err == nil && cp == k {
+				sync(k, synced)
+			} else if err := tolerate(err); err != nil {
+				return err
+			}
+		}
+		if k < from {
+			continue
+		}
+		if err := states(BlockState{Number: k, Balance: now.Balance(), Nonce: now.Nonce()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
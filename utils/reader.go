@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// readHeader retrieves the hash and header of the canonical block number.
+func readHeader(db ethdb.Reader, number uint64) (common.Hash, *types.Header, error) {
+	// ReadCanonicalHash retrieves the hash assigned to a canonical block number.
+	blkHash := rawdb.ReadCanonicalHash(db, number)
+	if blkHash == (common.Hash{}) {
+		return blkHash, nil, &BlockMissingError{Number: number, Part: "hash"}
+	}
+	// ReadHeader retrieves the block header corresponding to the hash.
+	blkHeader := rawdb.ReadHeader(db, blkHash, number)
+	if blkHeader == nil {
+		return blkHash, nil, &BlockMissingError{Number: number, Part: "header"}
+	}
+	return blkHash, blkHeader, nil
+}
+
+// readBody retrieves the body of the canonical block number.
+func readBody(db ethdb.Reader, number uint64) (*types.Body, error) {
+	blkHash := rawdb.ReadCanonicalHash(db, number)
+	if blkHash == (common.Hash{}) {
+		return nil, &BlockMissingError{Number: number, Part: "hash"}
+	}
+	// ReadBody retrieves the block body corresponding to the hash.
+	blkBody := rawdb.ReadBody(db, blkHash, number)
+	if blkBody == nil {
+		return nil, &BlockMissingError{Number: number, Part: "body"}
+	}
+	return blkBody, nil
+}
+
+// openState constructs the state trie of the canonical block number.
+func openState(src *ChainSource, number uint64) (*types.Header, *trie.StateTrie, error) {
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Retrieve state root and construct the trie accordingly, or take it from the cache
+	Trie, err := src.cache.stateTrie(src.TrieDB, blkHeader.Root)
+	if err != nil {
+		return blkHeader, nil, wrapTrieErr(err, number, blkHeader.Root)
+	}
+	return blkHeader, Trie, nil
+}
+
+// resolveState opens the state of block number. Under the fallback policy a
+// missing block or state is replaced by the nearest lower block whose state is
+// available, whose number is returned alongside the trie.
+func resolveState(src *ChainSource, number uint64) (uint64, *trie.StateTrie, error) {
+	_, Trie, err := openState(src, number)
+	if err == nil || onMissing != policyFallback || !isMissing(err) {
+		return number, Trie, err
+	}
+	for n := number; n > 0 && number-n < uint64(fallbackDepth); {
+		n--
+		if _, Trie, ferr := openState(src, n); ferr == nil {
+			fmt.Printf("Fallback: %v, using state of block %d.\n", err, n)
+			return n, Trie, nil
+		}
+	}
+	return number, nil, err
+}
+
+// readAccount retrieves the account of addr from the unmodified state trie of
+// block number, through the account cache and the snapshots of src.
+func readAccount(src *ChainSource, Trie *trie.StateTrie, addr common.Address, number uint64) (*types.StateAccount, error) {
+	root := Trie.Hash()
+	acc, err := src.cache.account(root, addr, func() (*types.StateAccount, error) {
+		if src.snaps != nil {
+			if acc, ok := src.snaps.account(root, addr); ok {
+				return acc, nil
+			}
+		}
+		return Trie.TryGetAccount(addr.Bytes())
+	})
+	if err != nil {
+		return nil, wrapTrieErr(err, number, Trie.Hash())
+	}
+	if acc == nil {
+		return nil, &AccountAbsentError{Number: number, Address: addr}
+	}
+	return acc, nil
+}
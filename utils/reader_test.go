@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveStatePolicies(t *testing.T) {
+	// The state of block 7 and the header of block 9 are gone
+	newGappedChain := func(policy missingPolicy, depth int) *testChain {
+		c := newTestChain(t, busyTransfers(12))
+		c.dropState(7)
+		c.dropHeader(9)
+		onMissing, fallbackDepth = policy, depth
+		return c
+	}
+	defer func() { onMissing, fallbackDepth = policyStop, 128 }()
+
+	c := newGappedChain(policyStop, 128)
+	if _, _, err := resolveState(c.src, 7); !errors.Is(err, ErrStateMissing) {
+		t.Errorf("stop: state of block 7 gives %v", err)
+	}
+	if _, _, err := resolveState(c.src, 9); !errors.Is(err, ErrBlockMissing) {
+		t.Errorf("stop: state of block 9 gives %v", err)
+	}
+	if _, err := originPointQuery(c.src, c.addrs[0].Hex(), 5, 10); err == nil {
+		t.Errorf("stop: query over the gaps gives %v", err)
+	}
+
+	c = newGappedChain(policySkip, 128)
+	accounts, err := originPointQuery(c.src, c.addrs[0].Hex(), 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := uint64(5); n <= 10; n++ {
+		if skipped := n == 7 || n == 9; (accounts[n] == nil) != skipped {
+			t.Errorf("skip: block %d answered %v", n, accounts[n])
+		}
+	}
+
+	c = newGappedChain(policyFallback, 128)
+	for n, want := range map[uint64]uint64{6: 6, 7: 6, 9: 8} {
+		base, _, err := resolveState(c.src, n)
+		if err != nil || base != want {
+			t.Errorf("fallback: block %d resolves to %d, %v, want %d", n, base, err, want)
+		}
+	}
+	accounts, err = originPointQuery(c.src, c.addrs[0].Hex(), 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, from := range map[uint64]uint64{7: 6, 9: 8} {
+		if got, want := accounts[n], accounts[from]; got == nil || got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce {
+			t.Errorf("fallback: block %d answered %+v, state of block %d is %+v", n, got, from, want)
+		}
+	}
+
+	// Fallback looks no further back than the depth
+	c = newGappedChain(policyFallback, 1)
+	c.dropState(6)
+	if _, _, err := resolveState(c.src, 7); !errors.Is(err, ErrStateMissing) {
+		t.Errorf("fallback depth 1: block 7 gives %v", err)
+	}
+	if base, _, err := resolveState(c.src, 9); err != nil || base != 8 {
+		t.Errorf("fallback depth 1: block 9 resolves to %d, %v", base, err)
+	}
+}
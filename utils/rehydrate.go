@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// rehydration records an account brought back into the reduced trie of a
+// pruned block.
+type rehydration struct {
+	Block     uint64         `json:"block"`
+	Address   common.Address `json:"address"`
+	Source    string         `json:"source"` // "replay" or "proof"
+	Balance   string         `json:"balance"`
+	Nonce     uint64         `json:"nonce"`
+	Root      common.Hash    `json:"root"` // of the reduced trie after the account is back
+	Committed bool           `json:"committed"`
+}
+
+// rehydrated reports whether account was already brought back into block number.
+func (w *windowEntry) rehydrated(account common.Address, number uint64) bool {
+	for _, r := range w.Rehydrated {
+		if r.Block == number && r.Address == account {
+			return true
+		}
+	}
+	return false
+}
+
+// reducedTrie opens the trie of block number as prune left it: the original
+// trie without the accounts deleted from it, except those rehydrated since.
+func reducedTrie(src *ChainSource, d *DeletedAccounts, w *windowEntry, number uint64) (*types.Header, *trie.StateTrie, error) {
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return nil, nil, err
+	}
+	Trie, err := trie.NewStateTrie(common.Hash{}, blkHeader.Root, src.TrieDB)
+	if err != nil {
+		return nil, nil, wrapTrieErr(err, number, blkHeader.Root)
+	}
+	for _, acc := range d.Deleted(number) {
+		if w.rehydrated(acc, number) {
+			continue
+		}
+		if err := Trie.TryDeleteAccount(acc.Bytes()); err != nil {
+			return nil, nil, wrapTrieErr(err, number, blkHeader.Root)
+		}
+	}
+	return blkHeader, Trie, nil
+}
+
+// provenAccount checks an eth_getProof style proof of account against the
+// state root of a block and returns the account it proves.
+func provenAccount(root common.Hash, account common.Address, proof *AccountProof) (*types.StateAccount, error) {
+	if proof.Address != account {
+		return nil, invalidProof("proof is for %v, not %v", proof.Address, account)
+	}
+	val, err := trie.VerifyProof(root, crypto.Keccak256(account.Bytes()), proofDB(proof.AccountProof))
+	if err != nil {
+		return nil, invalidProof("account proof: %v", err)
+	}
+	if val == nil {
+		return nil, invalidProof("account %v is absent from state %x", account, root)
+	}
+	acc := new(types.StateAccount)
+	if err := rlp.DecodeBytes(val, acc); err != nil {
+		return nil, invalidProof("account proof: %v", err)
+	}
+	return acc, nil
+}
+
+// replayedAccount rebuilds account at block number from the checkpoint where it
+// still exists plus replay. Balance and nonce are replayed, storage root and
+// code hash are taken from the checkpoint, since replay only models transfers.
+func replayedAccount(src *ChainSource, sched schedule, account common.Address, number uint64) (*types.StateAccount, error) {
+	_, acc, err := checkpointAccount(src, account, sched.below(number))
+	if errors.Is(err, ErrAccountAbsent) {
+		acc, err = emptyAccount(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l, err := ledgerAt(src, sched, account, number)
+	if err != nil {
+		return nil, err
+	}
+	acc.Balance, acc.Nonce = l.Balance(), l.Nonce()
+	return acc, nil
+}
+
+// rehydrate puts account back into the reduced trie of block number, in the
+// state a peer's proof gives or, without one, replay rebuilds. With commit the
+// new reduced trie is written to the trie database. The event is recorded in
+// the manifest window of the block.
+func rehydrate(src *ChainSource, account common.Address, number uint64, proof *AccountProof, commit bool) (*rehydration, error) {
+	m, err := loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	cp, ok := m.prunedWindow(number)
+	if !ok {
+		return nil, fmt.Errorf("block %d is in no pruned window", number)
+	}
+	w := m.Windows[cp]
+	d, err := LoadDeletedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if !d.PrunedAt(account, number) {
+		return nil, fmt.Errorf("account %v was not pruned at block %d", account, number)
+	}
+	if w.rehydrated(account, number) {
+		return nil, fmt.Errorf("account %v is already back in block %d", account, number)
+	}
+
+	blkHeader, Trie, err := reducedTrie(src, d, w, number)
+	if err != nil {
+		return nil, err
+	}
+	r := &rehydration{Block: number, Address: account}
+	var acc *types.StateAccount
+	if proof != nil {
+		r.Source = "proof"
+		acc, err = provenAccount(blkHeader.Root, account, proof)
+	} else {
+		r.Source = "replay"
+		acc, err = replayedAccount(src, m.checkpoints(), account, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := Trie.TryUpdateAccount(account.Bytes(), acc); err != nil {
+		return nil, wrapTrieErr(err, number, blkHeader.Root)
+	}
+	r.Balance, r.Nonce = acc.Balance.String(), acc.Nonce
+	r.Root = Trie.Hash()
+
+	if commit {
+		root, nodes, err := Trie.Commit(false)
+		if err != nil {
+			return nil, err
+		}
+		if nodes != nil {
+			if err := src.TrieDB.Update(trie.NewWithNodeSet(nodes)); err != nil {
+				return nil, err
+			}
+			if err := src.TrieDB.Commit(root, false, nil); err != nil {
+				return nil, err
+			}
+		}
+		r.Committed = true
+	}
+	w.Rehydrated = append(w.Rehydrated, *r)
+	return r, m.save()
+}
+
+// DoRehydrate brings a pruned account back into the trie of a block.
+func DoRehydrate(cmdline []string) {
+	fs := newFlagSet("rehydrate")
+	proofPath := fs.String("proof", "", "eth_getProof response of the account at the block to take its state from, instead of replay")
+	commit := fs.Bool("commit", false, "write the reduced trie with the account back to the trie database")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 2 {
+		fmt.Println("Error! Must indicate the account hash and the block number.")
+		return
+	}
+	var proof *AccountProof
+	if *proofPath != "" {
+		data, err := os.ReadFile(*proofPath)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		proof = new(AccountProof)
+		if err := json.Unmarshal(data, proof); err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	number, _, err := resolveBlocks(src, cmdline[1], cmdline[1])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	r, err := rehydrate(src, common.HexToAddress(cmdline[0]), uint64(number), proof, *commit)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	fmt.Printf("Account %v is back in block %d from %s: balance %v, nonce %d, reduced root %x (committed: %v).\n",
+		r.Address, r.Block, r.Source, r.Balance, r.Nonce, r.Root, r.Committed)
+}
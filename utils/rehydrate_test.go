@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+func TestRehydrateRestoresTrie(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadDeletedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := d.Deleted(13)
+	if len(deleted) == 0 {
+		t.Fatal("nothing pruned at block 13")
+	}
+
+	// Replay brings every account back as it was, so the original root returns
+	var r *rehydration
+	for _, addr := range deleted {
+		if r, err = rehydrate(c.src, addr, 13, nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if r.Source != "replay" {
+			t.Errorf("%v: rehydrated from %s", addr, r.Source)
+		}
+	}
+	if want := c.blocks[12].Root(); r.Root != want {
+		t.Errorf("rehydrated root %x, original %x", r.Root, want)
+	}
+	m, _ := loadManifest()
+	if got := len(m.Windows[15].Rehydrated); got != len(deleted) {
+		t.Errorf("manifest records %d rehydrations, want %d", got, len(deleted))
+	}
+	if _, err := rehydrate(c.src, deleted[0], 13, nil, false); err == nil {
+		t.Error("account rehydrated twice")
+	}
+	if _, err := rehydrate(c.src, common.Address{0x01}, 13, nil, false); err == nil {
+		t.Error("account that was never pruned rehydrated")
+	}
+}
+
+func TestRehydrateFromProof(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadDeletedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := d.Deleted(12)[0]
+	_, proof, err := proveAccount(c.src, addr, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A proof for another account is rejected
+	other := proof
+	other.Address = common.Address{0x01}
+	if _, err := rehydrate(c.src, addr, 12, &other, false); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("proof of another account gives %v", err)
+	}
+
+	r, err := rehydrate(c.src, addr, 12, &proof, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Source != "proof" || !r.Committed || r.Balance != proof.Balance.ToInt().String() {
+		t.Errorf("rehydration %+v", r)
+	}
+	// The committed reduced trie holds the account again
+	Trie, err := trie.NewStateTrie(common.Hash{}, r.Root, c.src.TrieDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := Trie.TryGetAccount(addr.Bytes())
+	if err != nil || acc == nil || acc.Nonce != r.Nonce {
+		t.Errorf("committed trie has %+v, %v", acc, err)
+	}
+}
@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// backwardReplay lets queries start from the next checkpoint and revert the
+// blocks down to the queried one when it is closer than the one below.
+var backwardReplay = true
+
+// replayEvent is one change replay applied to the account. Delta is In minus
+// Out minus Fee, all of them zero for miner rewards. A synced event is no
+// change of the chain but the jump to a checkpoint state replay didn't reach,
+// e.g. after contract internals it doesn't model; it only has Delta, Balance
+// and Nonce.
+type replayEvent struct {
+	Block   uint64
+	Tx      common.Hash // zero for miner rewards
+	Delta   *big.Int
+	In      *big.Int // value received
+	Out     *big.Int // value sent
+	Fee     *big.Int // gas paid as sender
+	Balance *big.Int
+	Nonce   uint64
+
+	Sent, Received bool // account is the sender, the recipient of Tx
+	Synced         bool
+}
+
+// checkpointAccount reads account at checkpoint cp. Under the fallback policy
+// it may come from an earlier block, whose number is returned.
+func checkpointAccount(src *ChainSource, account common.Address, cp uint64) (uint64, *types.StateAccount, error) {
+	base, Trie, err := resolveState(src, cp)
+	if err != nil {
+		return base, nil, err
+	}
+	acc, err := readAccount(src, Trie, account, base)
+	if errors.Is(err, ErrAccountAbsent) && onMissing == policyFallback {
+		// An account that doesn't exist yet holds nothing
+		return base, emptyAccount(), nil
+	}
+	if err != nil {
+		return base, nil, err
+	}
+	return base, acc, nil
+}
+
+// checkpointLedger loads the ledger of account at checkpoint cp like
+// checkpointAccount, except that an account absent from the trie starts empty
+// whatever the policy: it simply doesn't exist yet.
+func checkpointLedger(src *ChainSource, account common.Address, cp uint64) (uint64, ledger, error) {
+	base, acc, err := checkpointAccount(src, account, cp)
+	if errors.Is(err, ErrAccountAbsent) {
+		acc, err = emptyAccount(), nil
+	}
+	if err != nil {
+		return base, ledger{}, err
+	}
+	l, err := newLedger(acc)
+	return base, l, err
+}
+
+// emptyAccount returns the state of an account that doesn't exist yet.
+func emptyAccount() *types.StateAccount {
+	return &types.StateAccount{Balance: new(big.Int), Root: types.EmptyRootHash, CodeHash: crypto.Keccak256(nil)}
+}
+
+// replayBlock applies to l everything block number does to account: the plain
+// transfers it sends or receives, their fees and the miner rewards, and
+// returns the resulting ledger. If emit is set it is called after every
+// change. Every transaction sent by account must carry the nonce replay is at,
+// otherwise a NonceGapError is returned since the balance can't be trusted either.
+func replayBlock(db ethdb.Reader, number uint64, account common.Address, l ledger, emit func(replayEvent)) (ledger, error) {
+	_, blkHeader, err := readHeader(db, number)
+	if err != nil {
+		return l, err
+	}
+	blkBody, err := readBody(db, number)
+	if err != nil {
+		return l, err
+	}
+	return applyBlock(blkHeader, blkBody.Transactions, blkBody.Uncles, account, l, emit)
+}
+
+// applyBlock is replayBlock on a block already read. Transactions that don't
+// involve account may be left out, unless account is the coinbase, which
+// collects the tips of all of them.
+func applyBlock(blkHeader *types.Header, txs types.Transactions, uncles []*types.Header, account common.Address, l ledger, emit func(replayEvent)) (ledger, error) {
+	number := blkHeader.Number.Uint64()
+	var err error
+	changed := func(ev replayEvent) {
+		if emit == nil || ev.Tx == (common.Hash{}) && ev.Delta.Sign() == 0 {
+			return
+		}
+		ev.Block, ev.Balance, ev.Nonce = number, l.Balance(), l.Nonce()
+		emit(ev)
+	}
+	// The miner collects the tips and the block reward once the block is done
+	reward := blockReward(blkHeader, uncles, account)
+
+	// Retrieve transactions and perform rebuilding
+	for _, tx := range txs {
+		txFrom, err := getFromAddr(tx, blkHeader.Number)
+		if err != nil {
+			return l, err
+		}
+		if blkHeader.Coinbase == account {
+			reward.Add(reward, txTip(tx, blkHeader))
+		}
+		ev := replayEvent{Tx: tx.Hash(), In: new(big.Int), Out: new(big.Int), Fee: new(big.Int)}
+		if txFrom == account {
+			if tx.Nonce() != l.Nonce() {
+				return l, &NonceGapError{Number: number, Tx: tx.Hash(), Address: account, Want: l.Nonce(), Got: tx.Nonce()}
+			}
+			ev.Out.Set(tx.Value())
+			ev.Fee = txFee(tx, blkHeader)
+			l = l.send()
+			ev.Sent = true
+		}
+		if tx.To() != nil && *tx.To() == account {
+			ev.In.Set(tx.Value())
+			ev.Received = true
+		}
+		if ev.Sent || ev.Received {
+			ev.Delta = new(big.Int).Sub(ev.In, ev.Out)
+			ev.Delta.Sub(ev.Delta, ev.Fee)
+			if l, err = l.apply(ev.Delta); err != nil {
+				return l, fmt.Errorf("block %d tx %x: %w", number, tx.Hash(), err)
+			}
+			changed(ev)
+		}
+	}
+	if l, err = l.credit(reward); err != nil {
+		return l, fmt.Errorf("block %d reward: %v", number, err)
+	}
+	changed(replayEvent{Delta: reward, In: new(big.Int), Out: new(big.Int), Fee: new(big.Int)})
+	return l, nil
+}
+
+// revertBlock undoes replayBlock: given the ledger of account after block
+// number it returns the ledger before it. The transactions account sent in the
+// block must carry the nonces just below the one it is at.
+func revertBlock(db ethdb.Reader, number uint64, account common.Address, l ledger) (ledger, error) {
+	_, blkHeader, err := readHeader(db, number)
+	if err != nil {
+		return l, err
+	}
+	blkBody, err := readBody(db, number)
+	if err != nil {
+		return l, err
+	}
+	return unapplyBlock(blkHeader, blkBody.Transactions, blkBody.Uncles, account, l)
+}
+
+// unapplyBlock is revertBlock on a block already read. The changes are taken
+// back in reverse order, so every intermediate ledger is one forward replay
+// went through and a balance below zero still means a missed change.
+func unapplyBlock(blkHeader *types.Header, txs types.Transactions, uncles []*types.Header, account common.Address, l ledger) (ledger, error) {
+	number := blkHeader.Number.Uint64()
+	type change struct {
+		tx    *types.Transaction
+		delta *big.Int
+		sent  bool
+	}
+	var (
+		changes []change
+		sent    uint64
+		err     error
+	)
+	reward := blockReward(blkHeader, uncles, account)
+	for _, tx := range txs {
+		txFrom, err := getFromAddr(tx, blkHeader.Number)
+		if err != nil {
+			return l, err
+		}
+		if blkHeader.Coinbase == account {
+			reward.Add(reward, txTip(tx, blkHeader))
+		}
+		c := change{tx: tx, delta: new(big.Int)}
+		if txFrom == account {
+			c.delta.Sub(c.delta, tx.Value())
+			c.delta.Sub(c.delta, txFee(tx, blkHeader))
+			c.sent = true
+			sent++
+		}
+		if tx.To() != nil && *tx.To() == account {
+			c.delta.Add(c.delta, tx.Value())
+		} else if !c.sent {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	if sent > l.Nonce() {
+		return l, fmt.Errorf("%w in block %d: %v sent %d transactions but is at nonce %d", ErrNonceGap, number, account, sent, l.Nonce())
+	}
+	next := l.Nonce() - sent
+	for _, c := range changes {
+		if !c.sent {
+			continue
+		}
+		if c.tx.Nonce() != next {
+			return l, &NonceGapError{Number: number, Tx: c.tx.Hash(), Address: account, Want: next, Got: c.tx.Nonce()}
+		}
+		next++
+	}
+
+	if l, err = l.debit(reward); err != nil {
+		return l, fmt.Errorf("block %d reward: %w", number, err)
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		if l, err = l.apply(new(big.Int).Neg(c.delta)); err != nil {
+			return l, fmt.Errorf("block %d tx %x: %w", number, c.tx.Hash(), err)
+		}
+		if c.sent {
+			if l, err = l.unsend(); err != nil {
+				return l, err
+			}
+		}
+	}
+	return l, nil
+}
+
+// startLedger loads the ledger of account from the checkpoint closer to block
+// target and returns it with the block whose state it holds. From the next
+// checkpoint it reverts the blocks down to target; from the one at or below,
+// or a fallback state under it, the caller replays forward from the returned
+// block. The next checkpoint is only used if its own state is there.
+func startLedger(src *ChainSource, sched schedule, account common.Address, target uint64) (uint64, ledger, error) {
+	below := sched.below(target)
+	if above, ok := sched.above(target); ok && backwardReplay && above-target < target-below {
+		cp, l, err := checkpointLedger(src, account, above)
+		if err == nil && cp == above {
+			for k := above; k > target && err == nil; k-- {
+				l, err = revertBlock(src.DB, k, account, l)
+			}
+			if err == nil {
+				return target, l, nil
+			}
+			// A credit revert missed may be one forward replay doesn't cross
+			if !errors.Is(err, ErrMissedCredit) {
+				return cp, l, err
+			}
+		} else if err != nil && !isMissing(err) {
+			// E.g. a checkpoint beyond the head, replay forward instead
+			return cp, l, err
+		}
+	}
+	return checkpointLedger(src, account, below)
+}
+
+// resyncLedger continues a replay that missed a credit in block number, see
+// ErrMissedCredit: it loads the ledger of the checkpoint at or after the block,
+// the blocks in between can't be replayed. The original error is returned if
+// there is no such checkpoint or its state isn't there.
+func resyncLedger(src *ChainSource, sched schedule, account common.Address, number uint64, missed error) (uint64, ledger, error) {
+	cp, ok := number, sched.isCheckpoint(number)
+	if !ok {
+		if cp, ok = sched.above(number); !ok {
+			return number, ledger{}, missed
+		}
+	}
+	base, l, err := checkpointLedger(src, account, cp)
+	if err != nil || base != cp {
+		return number, ledger{}, missed
+	}
+	fmt.Printf("Resync: %v, %v continues from checkpoint %d.\n", missed, account, cp)
+	return cp, l, nil
+}
+
+// ledgerAt reconstructs the ledger of account after block target from the
+// closer checkpoint.
+func ledgerAt(src *ChainSource, sched schedule, account common.Address, target uint64) (ledger, error) {
+	base, l, err := startLedger(src, sched, account, target)
+	if err != nil {
+		return l, err
+	}
+	for k := base + 1; k <= target; k++ {
+		if l, err = replayBlock(src.DB, k, account, l, nil); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
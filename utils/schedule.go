@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// schedule places the checkpoints prune keeps and pruned queries start from.
+type schedule interface {
+	// below returns the checkpoint at or below number. A block before the
+	// first checkpoint is its own, it was never pruned.
+	below(number uint64) uint64
+	// above returns the first checkpoint after number, if there is one.
+	above(number uint64) (uint64, bool)
+	// isCheckpoint reports whether the state of number is kept.
+	isCheckpoint(number uint64) bool
+	// within returns the checkpoints in [from, to] in ascending order.
+	within(from uint64, to uint64) []uint64
+}
+
+// fixedSchedule keeps a checkpoint every so many blocks, on the multiples of
+// the interval.
+type fixedSchedule int
+
+func (n fixedSchedule) below(number uint64) uint64 {
+	return number - number%uint64(n)
+}
+
+func (n fixedSchedule) above(number uint64) (uint64, bool) {
+	return n.below(number) + uint64(n), true
+}
+
+func (n fixedSchedule) isCheckpoint(number uint64) bool {
+	return number%uint64(n) == 0
+}
+
+func (n fixedSchedule) within(from uint64, to uint64) []uint64 {
+	var cps []uint64
+	for cp := n.below(from + uint64(n) - 1); cp <= to; cp += uint64(n) {
+		cps = append(cps, cp)
+	}
+	return cps
+}
+
+// Metrics an adaptive schedule can spend its budget on.
+const (
+	metricTxs       = "txs"       // transactions replayed since the checkpoint
+	metricAddresses = "addresses" // distinct senders and recipients touched since the checkpoint
+	metricCost      = "cost"      // one unit per replayed block plus one per transaction
+)
+
+// adaptiveSchedule keeps a checkpoint wherever the replay from the previous
+// one would exceed Budget units of Metric, so busy stretches of the chain get
+// short windows and quiet ones long windows. Blocks lists the placements in
+// ascending order.
+type adaptiveSchedule struct {
+	Metric string   `json:"metric"`
+	Budget uint64   `json:"budget"`
+	Blocks []uint64 `json:"blocks"`
+}
+
+func (s *adaptiveSchedule) below(number uint64) uint64 {
+	i := sort.Search(len(s.Blocks), func(i int) bool { return s.Blocks[i] > number })
+	if i == 0 {
+		return number
+	}
+	return s.Blocks[i-1]
+}
+
+func (s *adaptiveSchedule) above(number uint64) (uint64, bool) {
+	i := sort.Search(len(s.Blocks), func(i int) bool { return s.Blocks[i] > number })
+	if i == len(s.Blocks) {
+		return 0, false
+	}
+	return s.Blocks[i], true
+}
+
+func (s *adaptiveSchedule) isCheckpoint(number uint64) bool {
+	i := sort.Search(len(s.Blocks), func(i int) bool { return s.Blocks[i] >= number })
+	return i < len(s.Blocks) && s.Blocks[i] == number
+}
+
+func (s *adaptiveSchedule) within(from uint64, to uint64) []uint64 {
+	i := sort.Search(len(s.Blocks), func(i int) bool { return s.Blocks[i] >= from })
+	j := sort.Search(len(s.Blocks), func(i int) bool { return s.Blocks[i] > to })
+	if i >= j {
+		return nil
+	}
+	return append([]uint64(nil), s.Blocks[i:j]...)
+}
+
+// merge takes over the placements of other in the range it covers and
+// returns the ones of s it replaced. The window of the first kept checkpoint
+// above the range may still reach into it, the caller has to re-prune it.
+func (s *adaptiveSchedule) merge(other *adaptiveSchedule) []uint64 {
+	if len(other.Blocks) == 0 {
+		return nil
+	}
+	low, high := other.Blocks[0], other.Blocks[len(other.Blocks)-1]
+	var kept, dropped []uint64
+	for _, cp := range s.Blocks {
+		if cp >= low && cp <= high {
+			dropped = append(dropped, cp)
+		} else {
+			kept = append(kept, cp)
+		}
+	}
+	s.Blocks = append(kept, other.Blocks...)
+	sort.Slice(s.Blocks, func(i, j int) bool { return s.Blocks[i] < s.Blocks[j] })
+	return dropped
+}
+
+// planSchedule walks [upNum, endNum] and places a checkpoint at upNum and at
+// every block that would bring the replay since the previous one over budget.
+func planSchedule(src *ChainSource, metric string, budget uint64, upNum uint64, endNum uint64) (*adaptiveSchedule, error) {
+	if metric != metricTxs && metric != metricAddresses && metric != metricCost {
+		return nil, fmt.Errorf("unknown checkpoint metric %q, must be txs, addresses or cost", metric)
+	}
+	s := &adaptiveSchedule{Metric: metric, Budget: budget, Blocks: []uint64{upNum}}
+	var (
+		spent   uint64
+		touched = map[common.Address]bool{}
+	)
+	for k := upNum + 1; k <= endNum; k++ {
+		if metric == metricCost {
+			spent++
+		}
+		blkBody, err := readBody(src.DB, k)
+		if err != nil {
+			if err := tolerate(err); err != nil {
+				return nil, err
+			}
+		} else {
+			switch metric {
+			case metricTxs, metricCost:
+				spent += uint64(len(blkBody.Transactions))
+			case metricAddresses:
+				for _, tx := range blkBody.Transactions {
+					txFrom, err := getFromAddr(tx, new(big.Int).SetUint64(k))
+					if err != nil {
+						return nil, err
+					}
+					touched[txFrom] = true
+					if tx.To() != nil {
+						touched[*tx.To()] = true
+					}
+				}
+				spent = uint64(len(touched))
+			}
+		}
+		// The state of a checkpoint is read, not replayed, so the next window starts empty
+		if spent > budget {
+			s.Blocks = append(s.Blocks, k)
+			spent = 0
+			touched = map[common.Address]bool{}
+		}
+	}
+	return s, nil
+}
+
+// queryCheckpoints returns the checkpoints a pruned query of [upNum, endNum]
+// reads: the one at or below upNum and every later one up to endNum.
+func queryCheckpoints(sched schedule, upNum uint64, endNum uint64) []uint64 {
+	return append([]uint64{sched.below(upNum)}, sched.within(upNum+1, endNum)...)
+}
+
+// parseSchedule reads the interval argument of the pruned queries: a fixed
+// interval, or "manifest" for the checkpoints the last prune placed.
+func parseSchedule(arg string) (schedule, error) {
+	if arg == "manifest" {
+		m, err := loadManifest()
+		if err != nil {
+			return nil, err
+		}
+		sched := m.checkpoints()
+		if sched == nil {
+			return nil, fmt.Errorf("no pruned manifest in %s, indicate the checkpoint interval", deletedDir)
+		}
+		return sched, nil
+	}
+	inter, err := parseInterval(arg)
+	if err != nil {
+		return nil, err
+	}
+	return inter, nil
+}
+
+// parseInterval reads a fixed checkpoint interval, which must be a positive
+// number of blocks.
+func parseInterval(arg string) (fixedSchedule, error) {
+	inter, err := strconv.Atoi(arg)
+	if err != nil || inter <= 0 {
+		return 0, fmt.Errorf("checkpoint interval %q is not a positive number of blocks", arg)
+	}
+	return fixedSchedule(inter), nil
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFixedSchedule(t *testing.T) {
+	s := fixedSchedule(5)
+	if got := s.within(1, 20); !reflect.DeepEqual(got, []uint64{5, 10, 15, 20}) {
+		t.Errorf("within(1, 20) = %v", got)
+	}
+	if got := s.within(0, 4); !reflect.DeepEqual(got, []uint64{0}) {
+		t.Errorf("within(0, 4) = %v", got)
+	}
+	if s.below(13) != 10 || s.below(15) != 15 || !s.isCheckpoint(15) || s.isCheckpoint(13) {
+		t.Errorf("fixed schedule misplaces checkpoints around 10 and 15")
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, arg := range []string{"abc", "0", "-5", ""} {
+		if _, err := parseSchedule(arg); err == nil {
+			t.Errorf("interval %q accepted", arg)
+		}
+	}
+	s, err := parseSchedule("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != fixedSchedule(5) {
+		t.Errorf("interval 5 gives %v", s)
+	}
+}
+
+func TestPlanSchedule(t *testing.T) {
+	// Every block has 5 transactions between the same 4 accounts
+	c := newTestChain(t, busyTransfers(20))
+	for _, tc := range []struct {
+		metric string
+		budget uint64
+		want   []uint64
+	}{
+		{metricTxs, 12, []uint64{1, 4, 7, 10, 13, 16, 19}},
+		{metricCost, 12, []uint64{1, 4, 7, 10, 13, 16, 19}},
+		{metricCost, 11, []uint64{1, 3, 5, 7, 9, 11, 13, 15, 17, 19}},
+		{metricAddresses, 4, []uint64{1}},
+		{metricAddresses, 3, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+	} {
+		s, err := planSchedule(c.src, tc.metric, tc.budget, 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(s.Blocks, tc.want) {
+			t.Errorf("%s budget %d: checkpoints %v, want %v", tc.metric, tc.budget, s.Blocks, tc.want)
+		}
+	}
+	if _, err := planSchedule(c.src, "gas", 1, 1, 20); err == nil {
+		t.Error("unknown metric accepted")
+	}
+}
+
+func TestAdaptivePrune(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	plan, err := planSchedule(c.src, metricTxs, 12, 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prune(c.src, plan, 1, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest records the placements and a window between each of them
+	m, err := loadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched := m.checkpoints()
+	if m.Schedule == nil || !reflect.DeepEqual(m.Schedule.Blocks, plan.Blocks) {
+		t.Fatalf("manifest schedule %+v, want %v", m.Schedule, plan.Blocks)
+	}
+	for i, cp := range plan.Blocks {
+		w := m.Windows[cp]
+		if w == nil {
+			t.Fatalf("window %d missing from manifest", cp)
+		}
+		if i > 0 && w.low() != plan.Blocks[i-1]+1 {
+			t.Errorf("window %d starts at %d, want %d", cp, w.low(), plan.Blocks[i-1]+1)
+		}
+	}
+	if sched.below(12) != 10 || sched.below(20) != 19 || sched.below(0) != 0 {
+		t.Errorf("manifest schedule places 12, 20 and 0 after %d, %d and %d", sched.below(12), sched.below(20), sched.below(0))
+	}
+
+	// Queries find the checkpoints through the manifest
+	for _, addr := range append(c.addrs, c.miner) {
+		origin, err := originPointQuery(c.src, addr.Hex(), 2, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pruned, err := prunedPointQuery(c.src, sched, addr.Hex(), 2, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, want := range origin {
+			got := pruned[n]
+			if got == nil || got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce {
+				t.Errorf("%v block %d: pruned %+v, origin %+v", addr, n, got, want)
+			}
+		}
+	}
+
+	// A rerun over part of the range replaces the placements there
+	replan, err := planSchedule(c.src, metricTxs, 12, 8, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prune(c.src, replan, 8, 20); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = loadManifest()
+	want := []uint64{1, 4, 7, 8, 11, 14, 17, 20}
+	if !reflect.DeepEqual(m.Schedule.Blocks, want) {
+		t.Errorf("merged schedule %v, want %v", m.Schedule.Blocks, want)
+	}
+	if len(m.Windows) != len(want) || m.Windows[10] != nil {
+		t.Errorf("merged manifest keeps windows of replaced checkpoints: %d windows", len(m.Windows))
+	}
+
+	// A rerun placing 9 and 12 replaces 11, and window 14 gives up block 12
+	replan, err = planSchedule(c.src, metricTxs, 12, 9, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prune(c.src, replan, 9, 13); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = loadManifest()
+	if want := []uint64{1, 4, 7, 8, 9, 12, 14, 17, 20}; !reflect.DeepEqual(m.Schedule.Blocks, want) {
+		t.Fatalf("merged schedule %v, want %v", m.Schedule.Blocks, want)
+	}
+	if w := m.Windows[14]; w == nil || w.low() != 13 {
+		t.Errorf("window 14 not re-pruned from block 13: %+v", w)
+	}
+	owner := map[uint64]uint64{}
+	for cp, w := range m.Windows {
+		for _, blk := range w.Blocks {
+			if other, ok := owner[blk.Number]; ok {
+				t.Errorf("block %d pruned in windows %d and %d", blk.Number, other, cp)
+			}
+			if m.Schedule.isCheckpoint(blk.Number) {
+				t.Errorf("checkpoint %d pruned in window %d", blk.Number, cp)
+			}
+			owner[blk.Number] = cp
+		}
+	}
+	if problems := checkDeletedFiles(m); len(problems) != 0 {
+		t.Errorf("deleted files after the rerun: %v", problems)
+	}
+}
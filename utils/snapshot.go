@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	// snapshotReads lets queries read accounts from snapshots before the trie
+	snapshotReads = false
+	// flattenCheckpoints makes prune write a flat copy of every checkpoint state
+	flattenCheckpoints = false
+	// flatDir holds the flattened checkpoint states, defaults to deletedDir/flat
+	flatDir = ""
+)
+
+// snapshotStats counts the account reads each path served.
+type snapshotStats struct {
+	Layers, Flat, Trie uint64
+}
+
+// stateSnapshots serves account reads without walking the trie. Geth's own
+// snapshot covers the head state and the diff layers of the last blocks, the
+// flat store holds a copy of each checkpoint state prune flattened. A state
+// neither covers is read from the trie.
+type stateSnapshots struct {
+	tree   *snapshot.Tree // nil if the database has no usable snapshot
+	flat   ethdb.Database
+	active bool
+	Stats  snapshotStats
+}
+
+// openSnapshots loads geth's snapshot layers on top of the head state and opens
+// the flat store.
+func openSnapshots(db ethdb.Database, triedb *trie.Database) (*stateSnapshots, error) {
+	s := &stateSnapshots{active: snapshotReads}
+	if head := rawdb.ReadHeadBlock(db); head != nil {
+		// Never rebuild, a missing or stale snapshot just isn't used
+		tree, err := snapshot.New(db, triedb, 16, head.Root(), false, false, false)
+		if err != nil {
+			fmt.Printf("Snapshot: no geth snapshot layers (%v).\n", err)
+		} else {
+			s.tree = tree
+		}
+	}
+	var err error
+	if backend == "memory" {
+		s.flat = rawdb.NewMemoryDatabase()
+	} else {
+		dir := flatDir
+		if dir == "" {
+			dir = filepath.Join(deletedDir, "flat")
+		}
+		s.flat, err = rawdb.NewLevelDBDatabase(dir, dbCache, handles, "", readOnly && !flattenCheckpoints)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stateSnapshots) close() error {
+	return s.flat.Close()
+}
+
+// flatKey is the key of an account in the flat copy of the state of root, the
+// root alone marks a complete copy.
+func flatKey(root common.Hash, accHash common.Hash) []byte {
+	return append(root.Bytes(), accHash.Bytes()...)
+}
+
+// account returns the account of addr in the state of root and whether a
+// snapshot covered that state. A covered but absent account is nil.
+func (s *stateSnapshots) account(root common.Hash, addr common.Address) (*types.StateAccount, bool) {
+	if !s.active {
+		return nil, false
+	}
+	return s.read(root, addr)
+}
+
+// covers reports whether a snapshot layer or a flat copy holds the state of root.
+func (s *stateSnapshots) covers(root common.Hash) bool {
+	if s.tree != nil && s.tree.Snapshot(root) != nil {
+		return true
+	}
+	ok, _ := s.flat.Has(root.Bytes())
+	return ok
+}
+
+// read is account whether or not queries read snapshots by default.
+func (s *stateSnapshots) read(root common.Hash, addr common.Address) (*types.StateAccount, bool) {
+	accHash := crypto.Keccak256Hash(addr.Bytes())
+	if s.tree != nil {
+		if layer := s.tree.Snapshot(root); layer != nil {
+			// A disk layer still being generated answers with an error
+			if slim, err := layer.Account(accHash); err == nil {
+				s.Stats.Layers++
+				return fromSlim(slim), true
+			}
+		}
+	}
+	if ok, _ := s.flat.Has(root.Bytes()); ok {
+		s.Stats.Flat++
+		data, err := s.flat.Get(flatKey(root, accHash))
+		if err != nil || len(data) == 0 {
+			return nil, true
+		}
+		slim, err := snapshot.FullAccount(data)
+		if err != nil {
+			return nil, false
+		}
+		return fromSlim(&slim), true
+	}
+	s.Stats.Trie++
+	return nil, false
+}
+
+func fromSlim(slim *snapshot.Account) *types.StateAccount {
+	if slim == nil {
+		return nil
+	}
+	acc := &types.StateAccount{Nonce: slim.Nonce, Balance: slim.Balance, Root: types.EmptyRootHash, CodeHash: crypto.Keccak256(nil)}
+	if len(slim.Root) > 0 {
+		acc.Root = common.BytesToHash(slim.Root)
+	}
+	if len(slim.CodeHash) > 0 {
+		acc.CodeHash = slim.CodeHash
+	}
+	return acc
+}
+
+// flatten writes a flat copy of the state of block number, unless there is one.
+func (s *stateSnapshots) flatten(src *ChainSource, number uint64) error {
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return err
+	}
+	root := blkHeader.Root
+	if ok, _ := s.flat.Has(root.Bytes()); ok {
+		return nil
+	}
+	Trie, err := trie.NewStateTrie(common.Hash{}, root, src.TrieDB)
+	if err != nil {
+		return wrapTrieErr(err, number, root)
+	}
+	batch := s.flat.NewBatch()
+	accounts := 0
+	it := trie.NewIterator(Trie.NodeIterator(nil))
+	for it.Next() {
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(it.Value, &acc); err != nil {
+			return err
+		}
+		slim := snapshot.SlimAccountRLP(acc.Nonce, acc.Balance, acc.Root, acc.CodeHash)
+		batch.Put(flatKey(root, common.BytesToHash(it.Key)), slim)
+		accounts++
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if it.Err != nil {
+		return wrapTrieErr(it.Err, number, root)
+	}
+	// The marker goes last so an interrupted copy is never used
+	batch.Put(root.Bytes(), []byte{1})
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	fmt.Printf("Flattened state of block %d: %d accounts.\n", number, accounts)
+	return nil
+}
+
+func (s snapshotStats) String() string {
+	return fmt.Sprintf("%d reads from snapshot layers, %d from flat checkpoints, %d fell back to the trie", s.Layers, s.Flat, s.Trie)
+}
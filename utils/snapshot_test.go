@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// snapshotSource opens a second source on the chain with snapshot reads and
+// checkpoint flattening on.
+func snapshotSource(t testing.TB, c *testChain) *ChainSource {
+	snapshotReads, flattenCheckpoints, backend = true, true, "memory"
+	t.Cleanup(func() { snapshotReads, flattenCheckpoints, backend = false, false, "leveldb" })
+	src, err := NewChainSource(c.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestFlatCheckpointReads(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	src := snapshotSource(t, c)
+	if err := prune(src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range append([]common.Address{c.miner}, c.addrs...) {
+		// The point query starts from the flattened checkpoints 5 to 20
+		want, err := prunedPointQuery(c.src, fixedSchedule(5), addr.Hex(), 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := prunedPointQuery(src, fixedSchedule(5), addr.Hex(), 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, acc := range want {
+			if got[n] == nil || got[n].Balance.Cmp(acc.Balance) != 0 || got[n].Nonce != acc.Nonce {
+				t.Errorf("%v at block %d: flat read %+v, trie read %+v", addr, n, got[n], acc)
+			}
+		}
+	}
+	if src.snaps.Stats.Flat == 0 || src.snaps.Stats.Trie != 0 {
+		t.Errorf("checkpoint reads: %v, want all from flat checkpoints", src.snaps.Stats)
+	}
+}
+
+func TestSnapshotLayerReads(t *testing.T) {
+	c := newTestChain(t, busyTransfers(5))
+	head := rawdb.ReadHeadBlock(c.db)
+	// Generate and persist a geth snapshot of the head state
+	tree, err := snapshot.New(c.db, trie.NewDatabase(c.db), 16, head.Root(), false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Journal(head.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	src := snapshotSource(t, c)
+	if src.snaps.tree == nil {
+		t.Fatal("generated snapshot not loaded")
+	}
+	for _, addr := range append([]common.Address{c.miner, {0x01}}, c.addrs...) {
+		_, Trie, err := openState(c.src, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, wantErr := readAccount(c.src, Trie, addr, 5)
+		got, gotErr := readAccount(src, Trie, addr, 5)
+		if (wantErr == nil) != (gotErr == nil) || want != nil && (got.Balance.Cmp(want.Balance) != 0 || got.Nonce != want.Nonce) {
+			t.Errorf("%v: snapshot read %+v (%v), trie read %+v (%v)", addr, got, gotErr, want, wantErr)
+		}
+	}
+	if src.snaps.Stats.Layers == 0 || src.snaps.Stats.Trie != 0 {
+		t.Errorf("head reads: %v, want all from snapshot layers", src.snaps.Stats)
+	}
+}
+
+func BenchmarkAccountReads(b *testing.B) {
+	c := newTestChain(b, busyTransfers(20))
+	src := snapshotSource(b, c)
+	if err := src.snaps.flatten(src, 20); err != nil {
+		b.Fatal(err)
+	}
+	for _, snap := range []bool{false, true} {
+		name := "trie"
+		if snap {
+			name = "flat"
+		}
+		b.Run(name, func(b *testing.B) {
+			src.snaps.active = snap
+			trieCacheEntries, accountCacheEntries = 0, 0
+			defer func() { trieCacheEntries, accountCacheEntries = 64, 1<<16 }()
+			src.resetCaches()
+			src.cache, _ = newQueryCache()
+			_, Trie, err := openState(src, 20)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < b.N; i++ {
+				if _, err := readAccount(src, Trie, c.addrs[i%len(c.addrs)], 20); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
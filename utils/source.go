@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	// backend is leveldb, or memory in tests that build their chain in place
+	// and want the flat checkpoint states in memory too
+	backend  = "leveldb"
+	dbCache  = 16
+	handles  = 1
+	readOnly = false
+)
+
+// ChainSource is the chain database opened once per run and shared by the
+// prune and query subsystems, together with the trie database on top of it,
+// the cache of the tries and accounts queries resolved and the timings of the
+// last queries.
+type ChainSource struct {
+	DB     ethdb.Database
+	TrieDB *trie.Database
+	cache  *queryCache
+	snaps  *stateSnapshots // nil unless snapshot reads or flattening are on
+
+	timings map[string]*queryStats // of the last query of each kind
+}
+
+// NewChainSource wraps an already opened database and loads its chain rules.
+func NewChainSource(db ethdb.Database) (*ChainSource, error) {
+	if err := loadChainConfig(db); err != nil {
+		return nil, err
+	}
+	cache, err := newQueryCache()
+	if err != nil {
+		return nil, err
+	}
+	// Create in-memory trie database, with a clean cache for the nodes read
+	triedb := trie.NewDatabaseWithConfig(db, &trie.Config{Cache: nodeCacheSize})
+	src := &ChainSource{DB: db, TrieDB: triedb, cache: cache, timings: map[string]*queryStats{}}
+	if snapshotReads || flattenCheckpoints {
+		if src.snaps, err = openSnapshots(db, triedb); err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// OpenChainSource opens the LevelDB chain database selected by the flags,
+// read-only with -readonly. There is no choice of backend: Pebble needs
+// go-ethereum v1.11 or later and we build against v1.10, so only LevelDB
+// databases can be opened.
+func OpenChainSource() (*ChainSource, error) {
+	ancient := ancientPath
+	if ancient == "" {
+		ancient = dbPath + "/ancient"
+	}
+	// Open ethereum levelDB with ancient flatten data
+	db, err := rawdb.NewLevelDBDatabaseWithFreezer(dbPath, dbCache, handles, ancient, "", readOnly)
+	if err != nil {
+		return nil, err
+	}
+	src, err := NewChainSource(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// Close releases the underlying database.
+func (s *ChainSource) Close() error {
+	if s.snaps != nil {
+		s.snaps.close()
+	}
+	return s.DB.Close()
+}
+
+// resetCaches drops every cached trie node, trie and account, so that runs
+// compared with each other start equally cold.
+func (s *ChainSource) resetCaches() {
+	s.cache.reset()
+	s.TrieDB = trie.NewDatabaseWithConfig(s.DB, &trie.Config{Cache: nodeCacheSize})
+}
+
+// printHead prints the current canonical head of the source.
+func (s *ChainSource) printHead() {
+	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
+	currHeader := rawdb.ReadHeadHeaderHash(s.DB)
+	fmt.Printf("currHeader: %x\n", currHeader)
+
+	// ReadHeaderNumber returns the header number assigned to a hash.
+	if currHeight := rawdb.ReadHeaderNumber(s.DB, currHeader); currHeight != nil {
+		fmt.Printf("currHeight: %d\n", *currHeight)
+	}
+}
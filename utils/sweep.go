@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// sweepRow is the outcome of one interval of a sweep: what prune deleted and
+// freed, and the query timings of the workload on the original and the pruned
+// tries. Times are in microseconds.
+type sweepRow struct {
+	Interval   int
+	Windows    int
+	Deleted    int
+	FreedBytes int
+	Origin     *queryStats
+	Pruned     *queryStats
+}
+
+// slowdown returns how many times slower the pruned queries are on average.
+func (r *sweepRow) slowdown() float64 {
+	if r.Origin.Average() == 0 {
+		return 0
+	}
+	return float64(r.Pruned.Average()) / float64(r.Origin.Average())
+}
+
+// sweep prunes [upNum, endNum] with every interval in turn and runs the
+// workload, point queries of every account or range queries of rangeint
+// blocks if it isn't 0, on the original and the pruned tries. Every query
+// starts from cold caches.
+func sweep(src *ChainSource, intervals []int, accounts []common.Address, upNum int, endNum int, rangeint int) ([]sweepRow, error) {
+	measureSpace = true
+	defer func() { measureSpace = false }()
+
+	originKind, prunedKind := timingOriginPoint, timingPrunedPoint
+	if rangeint > 0 {
+		originKind, prunedKind = timingOriginRange, timingPrunedRange
+	}
+	discard := func(BlockState) error { return nil }
+
+	var rows []sweepRow
+	for _, inter := range intervals {
+		fmt.Printf("======================= Interval %d =======================\n", inter)
+		sched := fixedSchedule(inter)
+		if err := prune(src, sched, upNum, endNum); err != nil {
+			return nil, err
+		}
+		m, err := loadManifest()
+		if err != nil {
+			return nil, err
+		}
+		row := sweepRow{Interval: inter, Origin: newQueryStats(), Pruned: newQueryStats()}
+		for _, cp := range sched.within(uint64(upNum), uint64(endNum)) {
+			w := m.Windows[cp]
+			row.Windows++
+			row.Deleted += w.Deleted
+			row.FreedBytes += w.Space.freedBytes()
+		}
+
+		for _, acc := range accounts {
+			src.resetCaches()
+			if rangeint > 0 {
+				err = originRangeQuery(src, acc.Hex(), upNum, endNum, rangeint, false, discard)
+			} else {
+				_, err = originPointQuery(src, acc.Hex(), upNum, endNum)
+			}
+			if err != nil {
+				return nil, err
+			}
+			row.Origin.add(src.timings[originKind])
+
+			src.resetCaches()
+			if rangeint > 0 {
+				err = prunedRangeQuery(src, sched, acc.Hex(), upNum, endNum, rangeint, false, discard)
+			} else {
+				_, err = prunedPointQuery(src, sched, acc.Hex(), upNum, endNum)
+			}
+			if err != nil {
+				return nil, err
+			}
+			row.Pruned.add(src.timings[prunedKind])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func printSweep(rows []sweepRow) {
+	fmt.Println("----------------------------Sweep----------------------------")
+	fmt.Printf("%8s %8s %10s %12s %12s %12s %12s %9s\n",
+		"interval", "windows", "deleted", "freed_bytes", "origin_avg", "pruned_avg", "pruned_max", "slowdown")
+	for _, r := range rows {
+		fmt.Printf("%8d %8d %10d %12d %9d us %9d us %9d us %8.2fx\n",
+			r.Interval, r.Windows, r.Deleted, r.FreedBytes, r.Origin.Average(), r.Pruned.Average(), r.Pruned.Longest, r.slowdown())
+	}
+}
+
+// writeSweep writes the table as CSV so sweeps can be plotted or joined.
+func writeSweep(path string, rows []sweepRow) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"interval", "windows", "deleted", "freed_bytes",
+		"origin_total_us", "origin_avg_us", "pruned_total_us", "pruned_avg_us", "pruned_max_us", "slowdown"})
+	us := func(d time.Duration) string { return strconv.FormatInt(int64(d), 10) }
+	for _, r := range rows {
+		w.Write([]string{strconv.Itoa(r.Interval), strconv.Itoa(r.Windows), strconv.Itoa(r.Deleted), strconv.Itoa(r.FreedBytes),
+			us(r.Origin.Total), us(r.Origin.Average()), us(r.Pruned.Total), us(r.Pruned.Average()), us(r.Pruned.Longest),
+			strconv.FormatFloat(r.slowdown(), 'f', 3, 64)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// DoSweep compares checkpoint intervals: for each it prunes the range and
+// times the query workload on the original and the pruned tries. The
+// deleted-account files and the manifest of the last interval are kept.
+func DoSweep(cmdline []string) {
+	fs := newFlagSet("sweep")
+	out := fs.String("csv", "", "also write the table to this CSV file")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 4 {
+		fmt.Println("Error! Must indicate the account hashes and the block intervals, both comma separated, and start/end block number.")
+		return
+	}
+	var accounts []common.Address
+	for _, acc := range strings.Split(cmdline[0], ",") {
+		accounts = append(accounts, common.HexToAddress(acc))
+	}
+	var intervals []int
+	for _, arg := range strings.Split(cmdline[1], ",") {
+		inter, err := parseInterval(arg)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		intervals = append(intervals, int(inter))
+	}
+	rangeint := 0
+	if len(cmdline) == 5 {
+		// the workload is range queries
+		var err error
+		if rangeint, err = strconv.Atoi(cmdline[4]); err != nil {
+			panic(err)
+		}
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	upNum, endNum, err := resolveBlocks(src, cmdline[2], cmdline[3])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	rows, err := sweep(src, intervals, accounts, upNum, endNum, rangeint)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	printSweep(rows)
+	if *out != "" {
+		if err := writeSweep(*out, rows); err != nil {
+			fmt.Println("Error!", err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSweepIntervals(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	accounts := []common.Address{c.addrs[0], c.addrs[2]}
+	rows, err := sweep(c.src, []int{5, 10}, accounts, 1, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d rows, want one per interval", len(rows))
+	}
+	if rows[0].Windows != 4 || rows[1].Windows != 2 {
+		t.Errorf("%d and %d windows, want 4 and 2", rows[0].Windows, rows[1].Windows)
+	}
+	// Longer windows see more repeated accounts
+	if rows[0].Deleted == 0 || rows[1].Deleted <= rows[0].Deleted {
+		t.Errorf("interval 5 deleted %d, interval 10 deleted %d", rows[0].Deleted, rows[1].Deleted)
+	}
+	for _, r := range rows {
+		if r.FreedBytes <= 0 {
+			t.Errorf("interval %d frees %d bytes", r.Interval, r.FreedBytes)
+		}
+		if want := 20 * len(accounts); r.Origin.Rounds != want || r.Pruned.Rounds != want {
+			t.Errorf("interval %d: %d origin and %d pruned queries, want %d", r.Interval, r.Origin.Rounds, r.Pruned.Rounds, want)
+		}
+	}
+	if measureSpace {
+		t.Error("sweep left space measurement on")
+	}
+
+	rows, err = sweep(c.src, []int{5}, accounts, 1, 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 5 * len(accounts); rows[0].Pruned.Rounds != want {
+		t.Errorf("%d pruned range queries, want %d", rows[0].Pruned.Rounds, want)
+	}
+}
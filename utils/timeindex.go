@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// timeIndexPath is the file caching header timestamps between runs, empty
+// disables the cache.
+var timeIndexPath = ""
+
+// timeLayouts are the accepted date forms of a block argument.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// timeIndex resolves timestamps to block numbers by binary search over header
+// times. Every header time read is remembered, and saved to timeIndexPath if
+// set, so later searches over the same chain mostly hit the cache. The saved
+// index starts with the genesis hash, so it is never read against another
+// chain.
+type timeIndex struct {
+	src     *ChainSource
+	genesis common.Hash
+	times   map[uint64]uint64
+	dirty   bool
+}
+
+// newTimeIndex loads the cached index if there is one.
+func newTimeIndex(src *ChainSource) (*timeIndex, error) {
+	genesis := rawdb.ReadCanonicalHash(src.DB, 0)
+	if genesis == (common.Hash{}) {
+		return nil, &BlockMissingError{Number: 0, Part: "hash"}
+	}
+	idx := &timeIndex{src: src, genesis: genesis, times: map[uint64]uint64{}}
+	if timeIndexPath == "" {
+		return idx, nil
+	}
+	file, err := os.Open(timeIndexPath)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("time index %s: %v", timeIndexPath, err)
+	}
+	if len(records) == 0 {
+		return idx, nil
+	}
+	if len(records[0]) != 2 || records[0][0] != "genesis" {
+		return nil, fmt.Errorf("time index %s has no genesis hash, delete it to rebuild", timeIndexPath)
+	}
+	if stored := common.HexToHash(records[0][1]); stored != genesis {
+		return nil, fmt.Errorf("time index %s is of the chain with genesis %x, not %x", timeIndexPath, stored, genesis)
+	}
+	for _, r := range records[1:] {
+		if len(r) != 2 {
+			return nil, fmt.Errorf("time index %s: malformed line %v", timeIndexPath, r)
+		}
+		number, err1 := strconv.ParseUint(r[0], 10, 64)
+		stamp, err2 := strconv.ParseUint(r[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("time index %s: malformed line %v", timeIndexPath, r)
+		}
+		idx.times[number] = stamp
+	}
+	return idx, nil
+}
+
+// save writes the index back if it learned new header times.
+func (idx *timeIndex) save() error {
+	if timeIndexPath == "" || !idx.dirty {
+		return nil
+	}
+	numbers := make([]uint64, 0, len(idx.times))
+	for n := range idx.times {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	file, err := os.Create(timeIndexPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"genesis", idx.genesis.Hex()})
+	for _, n := range numbers {
+		w.Write([]string{strconv.FormatUint(n, 10), strconv.FormatUint(idx.times[n], 10)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// blockTime returns the timestamp of the canonical block number.
+func (idx *timeIndex) blockTime(number uint64) (uint64, error) {
+	if t, ok := idx.times[number]; ok {
+		return t, nil
+	}
+	_, blkHeader, err := readHeader(idx.src.DB, number)
+	if err != nil {
+		return 0, err
+	}
+	idx.times[number] = blkHeader.Time
+	idx.dirty = true
+	return blkHeader.Time, nil
+}
+
+// head returns the number of the current canonical head.
+func (idx *timeIndex) head() (uint64, error) {
+	// ReadHeadHeaderHash retrieves the hash of the current canonical head header.
+	currHeader := rawdb.ReadHeadHeaderHash(idx.src.DB)
+	// ReadHeaderNumber returns the header number assigned to a hash.
+	currHeight := rawdb.ReadHeaderNumber(idx.src.DB, currHeader)
+	if currHeight == nil {
+		return 0, fmt.Errorf("no head header")
+	}
+	return *currHeight, nil
+}
+
+// blockAt returns the last block mined at or before t. With after set it
+// returns the first block mined at or after t instead.
+func (idx *timeIndex) blockAt(t time.Time, after bool) (uint64, error) {
+	head, err := idx.head()
+	if err != nil {
+		return 0, err
+	}
+	stamp := uint64(t.Unix())
+	var searchErr error
+	// First block whose time is past the stamp, or reaches it if after is set
+	n := sort.Search(int(head)+1, func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		bt, err := idx.blockTime(uint64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		if after {
+			return bt >= stamp
+		}
+		return bt > stamp
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if after {
+		if n > int(head) {
+			return 0, fmt.Errorf("no block at or after %v, head is block %d", t.UTC(), head)
+		}
+		return uint64(n), nil
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no block at or before %v", t.UTC())
+	}
+	return uint64(n - 1), nil
+}
+
+// parseTime parses a date argument, times without a zone are UTC.
+func parseTime(arg string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, arg); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// resolveBlocks turns the begin and end arguments of a command into block
+// numbers. Each is either a number or a date, a begin date resolves to the
+// first block at or after it and an end date to the last block at or before
+// it. The same date twice asks for the state at that time, the last block at
+// or before it. Two dates with no block between them give no range, an error.
+func resolveBlocks(src *ChainSource, upArg string, endArg string) (int, int, error) {
+	var idx *timeIndex
+	resolve := func(arg string, after bool) (int, error) {
+		if n, err := strconv.Atoi(arg); err == nil {
+			return n, nil
+		}
+		t, ok := parseTime(arg)
+		if !ok {
+			return 0, fmt.Errorf("%q is neither a block number nor a date", arg)
+		}
+		if idx == nil {
+			var err error
+			if idx, err = newTimeIndex(src); err != nil {
+				return 0, err
+			}
+		}
+		n, err := idx.blockAt(t, after)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Printf("%s resolves to block %d.\n", arg, n)
+		return int(n), nil
+	}
+	upNum, err := resolve(upArg, upArg != endArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	endNum, err := resolve(endArg, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if idx != nil {
+		if err := idx.save(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if upNum < 0 || endNum < 0 {
+		return 0, 0, fmt.Errorf("negative block number in %d to %d", upNum, endNum)
+	}
+	if upNum > endNum {
+		return 0, 0, fmt.Errorf("begin block %d is after end block %d", upNum, endNum)
+	}
+	return upNum, endNum, nil
+}
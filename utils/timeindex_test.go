@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveBlocksByDate(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	timeIndexPath = filepath.Join(t.TempDir(), "times.csv")
+	defer func() { timeIndexPath = "" }()
+
+	at := func(n uint64) time.Time {
+		_, h, err := readHeader(c.db, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Unix(int64(h.Time), 0).UTC()
+	}
+	// Between blocks 5 and 6 the range starts at 6, a point in time is block 5
+	between := at(5).Add(time.Second).Format(time.RFC3339)
+	cases := []struct {
+		up, end      string
+		wantUp, want int
+	}{
+		{at(3).Format(time.RFC3339), at(12).Format(time.RFC3339), 3, 12},
+		{between, at(20).Format(time.RFC3339), 6, 20},
+		{between, between, 5, 5},
+		{"2", between, 2, 5},
+	}
+	for _, tc := range cases {
+		up, end, err := resolveBlocks(c.src, tc.up, tc.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if up != tc.wantUp || end != tc.want {
+			t.Errorf("resolveBlocks(%s, %s) = %d, %d, want %d, %d", tc.up, tc.end, up, end, tc.wantUp, tc.want)
+		}
+	}
+	for _, bad := range [][2]string{
+		{at(20).Add(time.Hour).Format(time.RFC3339), "20"},
+		// No block between two dates inside the gap after block 5
+		{between, at(5).Add(2 * time.Second).Format(time.RFC3339)},
+		{"11", "10"},
+		{"-1", "10"},
+	} {
+		if up, end, err := resolveBlocks(c.src, bad[0], bad[1]); err == nil {
+			t.Errorf("resolveBlocks(%s, %s) = %d, %d", bad[0], bad[1], up, end)
+		}
+	}
+
+	// The header times probed by the searches were saved for the next run
+	idx, err := newTimeIndex(c.src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.times) == 0 {
+		t.Fatal("time index was not saved")
+	}
+	for n, stamp := range idx.times {
+		if got := uint64(at(n).Unix()); got != stamp {
+			t.Errorf("cached time of block %d is %d, header says %d", n, stamp, got)
+		}
+	}
+
+	// Another chain doesn't read the index
+	other := newTestChain(t, busyTransfers(3))
+	if _, err := newTimeIndex(other.src); err == nil {
+		t.Error("time index of another genesis was loaded")
+	}
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of queries whose timings the chain source keeps.
+const (
+	timingOriginPoint  = "origin point"
+	timingPrunedPoint  = "pruned point"
+	timingOriginRange  = "origin range"
+	timingPrunedRange  = "pruned range"
+	timingPlannedPoint = "planned point"
+)
+
+// queryStats times the rounds of a query, one block of a point query or one
+// sub-range of a range query. Longest and shortest report the second extreme,
+// so a single cold read or cache hit doesn't stand for the whole run. Total,
+// Longest and Shortest are in microseconds.
+type queryStats struct {
+	Rounds   int
+	Total    time.Duration
+	Internal time.Duration // spent rebuilding states, pruned point queries only
+	Longest  time.Duration
+	Shortest time.Duration
+
+	start                       time.Time
+	longest, shortest, short2nd time.Duration
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{start: time.Now(), shortest: 10000000, short2nd: 10000000, Shortest: 10000000}
+}
+
+// record adds the time of one round.
+func (s *queryStats) record(round time.Duration) {
+	roundElapsed := round / time.Microsecond
+	s.Rounds++
+	if roundElapsed > s.longest {
+		s.Longest = s.longest
+		s.longest = roundElapsed
+	} else if roundElapsed > s.Longest {
+		s.Longest = roundElapsed
+	}
+	if roundElapsed < s.shortest {
+		s.short2nd = s.shortest
+		s.shortest = roundElapsed
+	} else if roundElapsed > s.shortest && roundElapsed < s.short2nd {
+		s.short2nd = roundElapsed
+	}
+	s.Shortest = s.short2nd
+}
+
+// add merges the timings of another run of the same kind of query.
+func (s *queryStats) add(o *queryStats) {
+	s.Rounds += o.Rounds
+	s.Total += o.Total
+	s.Internal += o.Internal
+	if o.Longest > s.Longest {
+		s.Longest = o.Longest
+	}
+	if o.Shortest < s.Shortest {
+		s.Shortest = o.Shortest
+	}
+}
+
+// finish stops the clock of the whole query.
+func (s *queryStats) finish() {
+	s.Total = time.Since(s.start) / time.Microsecond
+}
+
+// Average returns the mean time of a round.
+func (s *queryStats) Average() time.Duration {
+	if s.Rounds == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Rounds)
+}
+
+func (s *queryStats) print() {
+	if s.Internal > 0 {
+		fmt.Printf("Total query time: %d us, internal time: %d us, average %d us.\n", s.Total, s.Internal/time.Microsecond, s.Average())
+	} else {
+		fmt.Printf("Total query time: %d us, average %d us.\n", s.Total, s.Average())
+	}
+	fmt.Printf("Longest query time: %d us, shortest %d us.\n", s.Longest, s.Shortest)
+}
+
+// finishQuery stops the clock of a query, prints its timings and keeps them in
+// the source under kind.
+func (s *ChainSource) finishQuery(kind string, stats *queryStats) {
+	stats.finish()
+	stats.print()
+	s.timings[kind] = stats
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// invalidProof wraps a failed check of a state proof.
+func invalidProof(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProof, fmt.Sprintf(format, args...))
+}
+
+// proofDB indexes proof nodes by hash as trie.VerifyProof looks them up.
+func proofDB(nodes proofList) *memorydb.Database {
+	db := memorydb.New()
+	for _, node := range nodes {
+		db.Put(crypto.Keccak256(node), node)
+	}
+	return db
+}
+
+// VerifyStateProof checks a StateProof without access to the chain and
+// returns the balance and nonce it proves. The headers must chain from the
+// checkpoint up to the block whose hash is trusted, the checkpoint account
+// must resolve against the checkpoint state root and the transactions of each
+// block must rebuild its tx root, so none can be left out. The balance and
+// nonce are then recomputed by the same replay rules the pruned engine uses,
+// under the current chain rules, and must match the answer in the proof.
+func VerifyStateProof(p *StateProof, trusted common.Hash) (*big.Int, uint64, error) {
+	if p.Checkpoint == nil || p.Checkpoint.Number == nil || p.Account.Balance == nil || p.Balance == nil {
+		return nil, 0, invalidProof("incomplete proof")
+	}
+	// The header chain, anchored at the trusted hash
+	last := p.Checkpoint
+	for i, b := range p.Replayed {
+		if b.Header == nil || b.Header.Number == nil {
+			return nil, 0, invalidProof("replayed block %d has no header", i)
+		}
+		for _, uncle := range b.Uncles {
+			if uncle == nil || uncle.Number == nil {
+				return nil, 0, invalidProof("block %v has an empty uncle", b.Header.Number)
+			}
+		}
+		if b.Header.ParentHash != last.Hash() {
+			return nil, 0, invalidProof("block after %v doesn't link to it", last.Number)
+		}
+		last = b.Header
+	}
+	if last.Hash() != trusted {
+		return nil, 0, invalidProof("last header %x is not the trusted %x", last.Hash(), trusted)
+	}
+	if last.Number.Uint64() != uint64(p.Block) {
+		return nil, 0, invalidProof("proof ends at block %v, not %d", last.Number, p.Block)
+	}
+
+	// The account at the checkpoint
+	val, err := trie.VerifyProof(p.Checkpoint.Root, crypto.Keccak256(p.Address.Bytes()), proofDB(p.Account.AccountProof))
+	if err != nil {
+		return nil, 0, invalidProof("account proof: %v", err)
+	}
+	acc := emptyAccount()
+	if val != nil {
+		if err := rlp.DecodeBytes(val, acc); err != nil {
+			return nil, 0, invalidProof("account proof: %v", err)
+		}
+	}
+	if acc.Balance.Cmp(p.Account.Balance.ToInt()) != 0 || acc.Nonce != uint64(p.Account.Nonce) {
+		return nil, 0, invalidProof("checkpoint account is balance %v nonce %d, proof claims %v nonce %d",
+			acc.Balance, acc.Nonce, p.Account.Balance, p.Account.Nonce)
+	}
+	now, err := newLedger(acc)
+	if err != nil {
+		return nil, 0, invalidProof("%v", err)
+	}
+
+	// The replayed blocks
+	for _, b := range p.Replayed {
+		number := b.Header.Number
+		if types.CalcUncleHash(b.Uncles) != b.Header.UncleHash {
+			return nil, 0, invalidProof("uncles of block %v don't match its header", number)
+		}
+		txs := make(types.Transactions, 0, len(b.Transactions))
+		for i, enc := range b.Transactions {
+			tx := new(types.Transaction)
+			if err := tx.UnmarshalBinary(enc); err != nil {
+				return nil, 0, invalidProof("tx %d of block %v: %v", i, number, err)
+			}
+			txs = append(txs, tx)
+		}
+		if types.DeriveSha(txs, trie.NewStackTrie(nil)) != b.Header.TxHash {
+			return nil, 0, invalidProof("transactions of block %v don't match its tx root", number)
+		}
+		if now, err = applyBlock(b.Header, txs, b.Uncles, p.Address, now, nil); err != nil {
+			return nil, 0, invalidProof("replay: %v", err)
+		}
+	}
+	if now.Balance().Cmp(p.Balance.ToInt()) != 0 || now.Nonce() != uint64(p.Nonce) {
+		return nil, 0, invalidProof("replay gives balance %v nonce %d, proof claims %v nonce %d",
+			now.Balance(), now.Nonce(), p.Balance, p.Nonce)
+	}
+	return now.Balance(), now.Nonce(), nil
+}
+
+// DoVerifyProof checks a proof written by "query prove" without opening a
+// chain database. The hash of the proven block has to come from a source the
+// verifier trusts, a proof can't vouch for itself.
+func DoVerifyProof(cmdline []string) {
+	fs := newFlagSet("verify-proof")
+	trustedHex := fs.String("trusted", "", "trusted hash of the proven block, required")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 1 {
+		fmt.Println("Error! Must indicate the proof file.")
+		return
+	}
+	var trusted common.Hash
+	if err := trusted.UnmarshalText([]byte(*trustedHex)); err != nil {
+		fmt.Println("Error! Must indicate the trusted 0x hash of the proven block with -trusted.")
+		return
+	}
+	// Without a database the chain rules can't come from the genesis
+	if _, ok := networks[network]; !ok {
+		fmt.Printf("Error! verify-proof reads no database, pass one of -network %s.\n", strings.Join(networkNames(), ", "))
+		return
+	}
+	if err := loadChainConfig(nil); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+
+	data, err := os.ReadFile(cmdline[0])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	var p StateProof
+	if err := json.Unmarshal(data, &p); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	balance, nonce, err := VerifyStateProof(&p, trusted)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	fmt.Printf("Proof valid: account %v had balance %v and nonce %d in block %d.\n", p.Address, balance, nonce, p.Block)
+}
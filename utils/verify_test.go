@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// decodedProof proves the state of addr at block 13 and returns it as a
+// verifier would read it, with the hash of block 13.
+func decodedProof(t *testing.T, c *testChain, addr common.Address) (*StateProof, common.Hash) {
+	p, err := proveState(c.src, fixedSchedule(5), addr, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec StateProof
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		t.Fatal(err)
+	}
+	return &dec, p.Replayed[len(p.Replayed)-1].Header.Hash()
+}
+
+func TestVerifyStateProof(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	for _, addr := range append([]common.Address{c.miner, {0x01}}, c.addrs...) {
+		p, trusted := decodedProof(t, c, addr)
+		balance, nonce, err := VerifyStateProof(p, trusted)
+		if err != nil {
+			t.Fatalf("%v: %v", addr, err)
+		}
+		if balance.Cmp(p.Balance.ToInt()) != 0 || nonce != uint64(p.Nonce) {
+			t.Errorf("%v: verified %v nonce %d, proof has %v nonce %d", addr, balance, nonce, p.Balance, p.Nonce)
+		}
+	}
+}
+
+func TestVerifyStateProofTampered(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	tampers := map[string]func(p *StateProof){
+		"balance": func(p *StateProof) {
+			p.Balance = (*hexutil.Big)(new(big.Int).Add(p.Balance.ToInt(), big.NewInt(1)))
+		},
+		"nonce": func(p *StateProof) { p.Nonce++ },
+		"checkpoint account": func(p *StateProof) {
+			p.Account.Balance = (*hexutil.Big)(new(big.Int).Add(p.Account.Balance.ToInt(), big.NewInt(1)))
+		},
+		"header": func(p *StateProof) { p.Replayed[1].Header.GasUsed++ },
+		"dropped block": func(p *StateProof) {
+			p.Replayed = append(p.Replayed[:1], p.Replayed[2:]...)
+		},
+		"dropped transaction": func(p *StateProof) {
+			b := &p.Replayed[0]
+			b.Transactions = b.Transactions[1:]
+		},
+		"transaction": func(p *StateProof) {
+			tx := p.Replayed[0].Transactions[0]
+			tx[len(tx)-1] ^= 1
+		},
+		"uncles": func(p *StateProof) { p.Replayed[0].Uncles = append(p.Replayed[0].Uncles, p.Checkpoint) },
+	}
+	for name, tamper := range tampers {
+		// The miner gets every transaction, so any change shows
+		p, trusted := decodedProof(t, c, c.miner)
+		tamper(p)
+		if _, _, err := VerifyStateProof(p, trusted); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("%s: tampered proof gives %v", name, err)
+		}
+	}
+
+	p, _ := decodedProof(t, c, c.addrs[0])
+	if _, _, err := VerifyStateProof(p, p.Checkpoint.Hash()); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("proof anchored at the wrong block gives %v", err)
+	}
+}
+
+func TestVerifyStateProofDroppedCredit(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	// An operator hides the 1000 wei account 1 receives in block 11
+	p, trusted := decodedProof(t, c, c.addrs[1])
+	b := &p.Replayed[0]
+	for i, enc := range b.Transactions {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(enc); err != nil {
+			t.Fatal(err)
+		}
+		if tx.To() != nil && *tx.To() == c.addrs[1] {
+			b.Transactions = append(b.Transactions[:i:i], b.Transactions[i+1:]...)
+			p.Balance = (*hexutil.Big)(new(big.Int).Sub(p.Balance.ToInt(), tx.Value()))
+			break
+		}
+	}
+	if len(b.Transactions) != 4 {
+		t.Fatalf("block 11 has no transfer to account 1")
+	}
+	if _, _, err := VerifyStateProof(p, trusted); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("proof without an incoming transfer gives %v", err)
+	}
+}
+
+func TestVerifyStateProofMalformed(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	p, trusted := decodedProof(t, c, c.miner)
+	enc, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformations := map[string]func(p map[string]interface{}){
+		"no checkpoint": func(p map[string]interface{}) { p["checkpoint"] = nil },
+		"no header": func(p map[string]interface{}) {
+			p["replayed"].([]interface{})[1].(map[string]interface{})["header"] = nil
+		},
+		"empty uncle": func(p map[string]interface{}) {
+			p["replayed"].([]interface{})[0].(map[string]interface{})["uncles"] = []interface{}{nil}
+		},
+		"no replayed blocks": func(p map[string]interface{}) { p["replayed"] = nil },
+	}
+	for name, malform := range malformations {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(enc, &raw); err != nil {
+			t.Fatal(err)
+		}
+		malform(raw)
+		data, _ := json.Marshal(raw)
+		var bad StateProof
+		if err := json.Unmarshal(data, &bad); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, _, err := VerifyStateProof(&bad, trusted); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("%s: malformed proof gives %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/misc"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Witness is what a node without the state needs to execute a block: the
+// account and storage trie nodes execution reads from the parent state, the
+// codes of the contracts it runs and the ancestor headers BLOCKHASH asks for.
+type Witness struct {
+	Block    hexutil.Uint64   `json:"block"`
+	Root     common.Hash      `json:"root"` // parent state root
+	Nodes    []hexutil.Bytes  `json:"nodes"`
+	Codes    []hexutil.Bytes  `json:"codes"`
+	Headers  []*types.Header  `json:"headers,omitempty"`
+	Accounts []common.Address `json:"accounts"` // senders, recipients and miners of the block
+}
+
+// size returns the bytes of nodes and codes in the witness.
+func (w *Witness) size() int {
+	total := 0
+	for _, node := range w.Nodes {
+		total += len(node)
+	}
+	for _, code := range w.Codes {
+		total += len(code)
+	}
+	return total
+}
+
+// recordingDB passes reads through to the database and keeps every trie node
+// and contract code they return.
+type recordingDB struct {
+	ethdb.Database
+	mu    sync.Mutex
+	nodes map[common.Hash][]byte
+	codes map[common.Hash][]byte
+}
+
+func newRecordingDB(db ethdb.Database) *recordingDB {
+	return &recordingDB{Database: db, nodes: map[common.Hash][]byte{}, codes: map[common.Hash][]byte{}}
+}
+
+func (r *recordingDB) Get(key []byte) ([]byte, error) {
+	val, err := r.Database.Get(key)
+	if err != nil {
+		return val, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok, hash := rawdb.IsCodeKey(key); ok {
+		r.codes[common.BytesToHash(hash)] = common.CopyBytes(val)
+	} else if len(key) == common.HashLength && bytes.Equal(crypto.Keccak256(val), key) {
+		// Trie nodes, and codes stored under their plain hash by old databases
+		r.nodes[common.BytesToHash(key)] = common.CopyBytes(val)
+	}
+	return val, nil
+}
+
+// chainContext serves the headers execution asks for. The miner is always
+// passed explicitly, so no consensus engine is needed.
+type chainContext struct {
+	get func(hash common.Hash, number uint64) *types.Header
+}
+
+func (c *chainContext) Engine() consensus.Engine { return nil }
+
+func (c *chainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return c.get(hash, number)
+}
+
+// executeBlock runs the transactions of a block and its rewards on the state
+// of root in db and returns the resulting state root.
+func executeBlock(db ethdb.Database, root common.Hash, blkHeader *types.Header, txs types.Transactions, uncles []*types.Header, chain core.ChainContext) (common.Hash, error) {
+	statedb, err := state.New(root, state.NewDatabase(db), nil)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(blkHeader.Number) == 0 {
+		misc.ApplyDAOHardFork(statedb)
+	}
+	var (
+		gp   = new(core.GasPool).AddGas(blkHeader.GasLimit)
+		used uint64
+	)
+	for i, tx := range txs {
+		statedb.Prepare(tx.Hash(), i)
+		if _, err := core.ApplyTransaction(chainConfig, chain, &blkHeader.Coinbase, gp, statedb, blkHeader, tx, &used, vm.Config{}); err != nil {
+			return common.Hash{}, fmt.Errorf("block %d tx %d: %v", blkHeader.Number, i, err)
+		}
+	}
+	// Every miner of the block and its uncles gets its reward once
+	for _, miner := range blockMiners(blkHeader, uncles) {
+		statedb.AddBalance(miner, blockReward(blkHeader, uncles, miner))
+	}
+	root = statedb.IntermediateRoot(chainConfig.IsEIP158(blkHeader.Number))
+	// The state swallows missing nodes, they only show here
+	if err := statedb.Error(); err != nil {
+		return common.Hash{}, err
+	}
+	return root, nil
+}
+
+// blockMiners returns the coinbase of a block and of its uncles, each once.
+func blockMiners(blkHeader *types.Header, uncles []*types.Header) []common.Address {
+	miners := []common.Address{blkHeader.Coinbase}
+	for _, uncle := range uncles {
+		seen := false
+		for _, miner := range miners {
+			seen = seen || miner == uncle.Coinbase
+		}
+		if !seen {
+			miners = append(miners, uncle.Coinbase)
+		}
+	}
+	return miners
+}
+
+// generateWitness executes block number on the state of its parent and
+// records what execution read. The execution has to reach the state root of
+// the header, otherwise the witness would be incomplete.
+func generateWitness(src *ChainSource, number uint64) (*Witness, error) {
+	if number == 0 {
+		return nil, fmt.Errorf("the genesis block isn't executed")
+	}
+	_, parent, err := readHeader(src.DB, number-1)
+	if err != nil {
+		return nil, err
+	}
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		return nil, err
+	}
+	blkBody, err := readBody(src.DB, number)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Witness{Block: hexutil.Uint64(number), Root: parent.Root}
+	rec := newRecordingDB(src.DB)
+	chain := &chainContext{get: func(hash common.Hash, n uint64) *types.Header {
+		h := rawdb.ReadHeader(src.DB, hash, n)
+		if h != nil {
+			w.Headers = append(w.Headers, h)
+		}
+		return h
+	}}
+	root, err := executeBlock(rec, parent.Root, blkHeader, blkBody.Transactions, blkBody.Uncles, chain)
+	if err != nil {
+		return nil, err
+	}
+	if root != blkHeader.Root {
+		return nil, fmt.Errorf("block %d: execution gives state root %x, header has %x", number, root, blkHeader.Root)
+	}
+
+	for _, node := range sortedValues(rec.nodes) {
+		w.Nodes = append(w.Nodes, node)
+	}
+	for _, code := range sortedValues(rec.codes) {
+		w.Codes = append(w.Codes, code)
+	}
+	touched := map[common.Address]bool{}
+	for _, miner := range blockMiners(blkHeader, blkBody.Uncles) {
+		touched[miner] = true
+	}
+	for _, tx := range blkBody.Transactions {
+		txFrom, err := getFromAddr(tx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return nil, err
+		}
+		touched[txFrom] = true
+		if tx.To() != nil {
+			touched[*tx.To()] = true
+		}
+	}
+	for acc := range touched {
+		w.Accounts = append(w.Accounts, acc)
+	}
+	sort.Slice(w.Accounts, func(i, j int) bool { return bytes.Compare(w.Accounts[i][:], w.Accounts[j][:]) < 0 })
+	return w, nil
+}
+
+// sortedValues returns the values of m ordered by key, so witnesses of the
+// same block are identical.
+func sortedValues(m map[common.Hash][]byte) [][]byte {
+	keys := make([]common.Hash, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = m[key]
+	}
+	return values
+}
+
+// checkWitnessFor checks that a witness read from a file is the one of block
+// number, built on the state of its parent. Execution alone can't tell, a
+// witness of another pre-state may still reach the header root.
+func checkWitnessFor(w *Witness, number uint64, parent *types.Header) error {
+	if uint64(w.Block) != number {
+		return fmt.Errorf("witness is of block %d, not %d", w.Block, number)
+	}
+	if w.Root != parent.Root {
+		return fmt.Errorf("witness of block %d starts from state root %x, parent block %d has %x", number, w.Root, parent.Number, parent.Root)
+	}
+	return nil
+}
+
+// verifyWitness executes a block on nothing but the witness, as a node that
+// pruned every account could, and checks it reaches the state root of the
+// header.
+func verifyWitness(w *Witness, blkHeader *types.Header, txs types.Transactions, uncles []*types.Header) error {
+	db := rawdb.NewMemoryDatabase()
+	for _, node := range w.Nodes {
+		db.Put(crypto.Keccak256(node), node)
+	}
+	for _, code := range w.Codes {
+		rawdb.WriteCode(db, crypto.Keccak256Hash(code), code)
+	}
+	headers := map[common.Hash]*types.Header{}
+	for _, h := range w.Headers {
+		headers[h.Hash()] = h
+	}
+	chain := &chainContext{get: func(hash common.Hash, number uint64) *types.Header {
+		return headers[hash]
+	}}
+	root, err := executeBlock(db, w.Root, blkHeader, txs, uncles, chain)
+	if err != nil {
+		return fmt.Errorf("stateless execution of block %d: %v", blkHeader.Number, err)
+	}
+	if root != blkHeader.Root {
+		return fmt.Errorf("stateless execution of block %d gives state root %x, header has %x", blkHeader.Number, root, blkHeader.Root)
+	}
+	return nil
+}
+
+// DoWitness writes the witness of a block, checks that it is enough to execute
+// the block without any state and reports which of the accounts it touches a
+// prune deleted from the parent trie.
+func DoWitness(cmdline []string) {
+	fs := newFlagSet("witness")
+	out := fs.String("out", "", "write the witness to this file")
+	in := fs.String("verify", "", "verify this witness file instead of generating one")
+	if err := fs.Parse(cmdline); err != nil {
+		return
+	}
+	cmdline = fs.Args()
+	if len(cmdline) < 1 {
+		fmt.Println("Error! Must indicate the block number.")
+		return
+	}
+
+	src, err := OpenChainSource()
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	defer src.Close()
+	n, _, err := resolveBlocks(src, cmdline[0], cmdline[0])
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	number := uint64(n)
+	if number == 0 {
+		fmt.Println("Error! The genesis block isn't executed, it has no witness.")
+		return
+	}
+
+	var w *Witness
+	if *in != "" {
+		data, err := os.ReadFile(*in)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		w = new(Witness)
+		if err := json.Unmarshal(data, w); err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		_, parent, err := readHeader(src.DB, number-1)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		if err := checkWitnessFor(w, number, parent); err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+	} else if w, err = generateWitness(src, number); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	fmt.Printf("Witness of block %d: %d nodes, %d codes, %d headers, %d bytes.\n", number, len(w.Nodes), len(w.Codes), len(w.Headers), w.size())
+
+	_, blkHeader, err := readHeader(src.DB, number)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	blkBody, err := readBody(src.DB, number)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	if err := verifyWitness(w, blkHeader, blkBody.Transactions, blkBody.Uncles); err != nil {
+		fmt.Println("Error!", err)
+		return
+	}
+	fmt.Println("Stateless execution reaches the state root of the header.")
+
+	// The accounts a prune took out of the parent trie are only in the witness
+	if d, err := LoadDeletedAccounts(); err == nil {
+		pruned := 0
+		for _, acc := range w.Accounts {
+			if d.PrunedAt(acc, number-1) {
+				pruned++
+			}
+		}
+		fmt.Printf("%d of the %d accounts the block touches were pruned from the trie of block %d.\n", pruned, len(w.Accounts), number-1)
+	}
+
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Println("Error!", err)
+			return
+		}
+		defer file.Close()
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(w); err != nil {
+			fmt.Println("Error!", err)
+		}
+	}
+}
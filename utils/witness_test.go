@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestWitnessExecutesStateless(t *testing.T) {
+	c := newTestChain(t, busyTransfers(20))
+	w, err := generateWitness(c.src, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Nodes) == 0 {
+		t.Fatal("empty witness")
+	}
+	// Four senders and recipients plus the miner
+	if len(w.Accounts) != 5 {
+		t.Errorf("witness touches %d accounts, want 5", len(w.Accounts))
+	}
+
+	// Pruning the parent trie doesn't matter, the witness carries the state
+	if err := prune(c.src, fixedSchedule(5), 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	block := c.blocks[12]
+	if err := verifyWitness(w, block.Header(), block.Transactions(), block.Uncles()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A witness is only taken for the block and parent state it was built for
+	if err := checkWitnessFor(w, 13, c.blocks[11].Header()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWitnessFor(w, 14, c.blocks[12].Header()); err == nil {
+		t.Error("witness of block 13 taken for block 14")
+	}
+	if err := checkWitnessFor(w, 13, c.blocks[10].Header()); err == nil {
+		t.Error("witness of block 13 taken on the state of block 11")
+	}
+
+	// Without any one node execution can't finish
+	for drop := range w.Nodes {
+		short := *w
+		short.Nodes = append(w.Nodes[:drop:drop], w.Nodes[drop+1:]...)
+		if err := verifyWitness(&short, block.Header(), block.Transactions(), block.Uncles()); err == nil {
+			t.Fatalf("witness without node %d verified", drop)
+		}
+	}
+}